@@ -6,4 +6,5 @@ require golang.org/x/term v0.29.0
 
 require (
 	golang.org/x/sys v0.30.0
+	golang.org/x/text v0.22.0
 )
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// clientConfig is what LunaRC remembers between runs, in config.json in the lunarc directory of the user's config directory.
+// url is the url to connect to when none is typed, ca is a file of extra certificates to trust servers by, alongside the system's,
+// pins holds the fingerprint of the key that each server that we connected to over wss last presented, by host and port, including the servers that the system or ca vouch for,
+// so that a certificate that they don't vouch for is only trusted on first use for servers that we have never connected to,
+// tokens holds the token to connect to each server that asks for one with, also by host and port,
+// key is the seed of the ed25519 key that we prove who we are with, and known holds the key that each nick was first seen with, by nick
+type clientConfig struct {
+	URL    string            `json:"url,omitempty"`
+	CA     string            `json:"ca,omitempty"`
+	Pins   map[string]string `json:"pins,omitempty"`
+	Tokens map[string]string `json:"tokens,omitempty"`
+	Key    string            `json:"key,omitempty"`
+	Known  map[string]string `json:"known,omitempty"`
+}
+
+var (
+	confMu sync.Mutex
+	conf   clientConfig
+)
+
+// configPath returns where the config is kept
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "lunarc", "config.json"), nil
+}
+
+// loadConfig reads the config, leaving it empty if there isn't one yet
+func loadConfig() error {
+	confMu.Lock()
+	defer confMu.Unlock()
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &conf)
+}
+
+// saveConfig writes the config, and must be called with confMu held. It is written to a temporary file that replaces the old one,
+// so that a crash part way through never loses the pins
+func saveConfig() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(conf, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, b, 0o600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
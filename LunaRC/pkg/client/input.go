@@ -4,7 +4,10 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"slices"
 	"strconv"
+	"unicode"
+	"unicode/utf8"
 	"weblrc"
 
 	"github.com/gorilla/websocket"
@@ -36,9 +39,10 @@ var (
 )
 
 func AcceptInput() {
-	buf := make([]byte, 10)
+	buf := make([]byte, 1024)
+	var partial []byte
 	quit := make(chan struct{})
-	send := make(chan events.LRCEvent)
+	send := make(chan events.Event)
 	var conn *websocket.Conn
 quitloop:
 	for {
@@ -50,7 +54,11 @@ quitloop:
 			if err != nil {
 				panic(err)
 			}
-			input := buf[:n]
+			input := append(partial, buf[:n]...)
+			input, partial = splitPartialRune(input)
+			if len(input) == 0 {
+				continue
+			}
 
 			switch is {
 			case menuNormal:
@@ -62,21 +70,49 @@ quitloop:
 			case chanInsert:
 				inputChanInsert(input, quit, send)
 			}
+			refreshRoster()
 		}
 	}
 	hangUp(conn)
 }
 
-func inputMenuNormal(buf []byte, quit chan struct{}, send chan events.LRCEvent) *websocket.Conn {
+// splitPartialRune splits off any bytes at the end of b that begin a rune which has not been fully read yet
+func splitPartialRune(b []byte) ([]byte, []byte) {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if utf8.FullRune(b[i:]) {
+				return b, nil
+			}
+			return b[:i], slices.Clone(b[i:])
+		}
+	}
+	return b, nil
+}
+
+// typeIntoCmdBuffer adds the printable characters in buf to the cmdBuffer, as long as it has less than limit characters, and backspaces on delete
+func typeIntoCmdBuffer(buf []byte, limit int) {
+	for _, r := range string(buf) {
+		if unicode.IsPrint(r) {
+			if utf8.RuneCountInString(cmdBuffer) < limit {
+				cmdBuffer = cmdBuffer + string(r)
+			}
+		} else if r == 127 {
+			if cmdBuffer != "" {
+				_, size := utf8.DecodeLastRuneInString(cmdBuffer)
+				cmdBuffer = cmdBuffer[:len(cmdBuffer)-size]
+			}
+		}
+	}
+}
+
+func inputMenuNormal(buf []byte, quit chan struct{}, send chan events.Event) *websocket.Conn {
 	switch buf[0] {
 	case 10, 13:
-		conn := ConnectToChannel(as.url, quit, send)
-		if conn != nil {
-			is = chanNormal
-			initChan()
-			cursor = math.MaxUint16
-			return conn
-		}
+		// the channel is set up before connecting, so that the history and snapshot the server sends straight away are not cleared
+		is = chanNormal
+		initChan()
+		cursor = math.MaxUint16
+		return ConnectToChannel(as.url, quit, send)
 	case 58:
 		switchToMenuInsert()
 	case 113:
@@ -89,7 +125,7 @@ func switchToMenuInsert() {
 	is = menuInsert
 }
 
-func inputMenuInsert(buf []byte, quit chan struct{}, send chan events.LRCEvent) {
+func inputMenuInsert(buf []byte, quit chan struct{}, send chan events.Event) {
 	switch buf[0] {
 	case 10, 13:
 		evaluateCommandBuffer(quit, send)
@@ -97,21 +133,15 @@ func inputMenuInsert(buf []byte, quit chan struct{}, send chan events.LRCEvent)
 	case 27:
 		switchToMenuNormal()
 	default:
-		if buf[0] > 31 && buf[0] < 127 {
-			cmdBuffer = cmdBuffer + string(buf[0])
-		} else if buf[0] == 127 {
-			if cmdBuffer != "" {
-				cmdBuffer = string(cmdBuffer[:len(cmdBuffer)-1])
-			}
-		}
+		typeIntoCmdBuffer(buf, math.MaxInt)
 	}
 }
 
-func evaluateCommandBuffer(quit chan struct{}, send chan events.LRCEvent) {
+func evaluateCommandBuffer(quit chan struct{}, send chan events.Event) {
 	if cmdBuffer == "q" {
 		close(quit)
 	}
-	if cmdBuffer[0] == '/' {
+	if cmdBuffer != "" && cmdBuffer[0] == '/' {
 		as.url = string(cmdBuffer[1:])
 		ConnectToChannel(as.url, quit, send)
 	}
@@ -121,7 +151,7 @@ func switchToMenuNormal() {
 	is = menuNormal
 }
 
-func inputChanNormal(buf []byte, quit chan struct{}, send chan events.LRCEvent) {
+func inputChanNormal(buf []byte, quit chan struct{}, send chan events.Event) {
 	switch cs {
 	case none:
 		switch buf[0] {
@@ -129,7 +159,12 @@ func inputChanNormal(buf []byte, quit chan struct{}, send chan events.LRCEvent)
 			setMyColor()
 		case 100:
 			dumpCmdLog()
+		case 82:
+			replyToSelected()
 		case 105:
+			if cursor == math.MaxUint16 {
+				replyTo = 0
+			}
 			switchToChanInsert()
 			cursorHome()
 		case 106:
@@ -138,38 +173,32 @@ func inputChanNormal(buf []byte, quit chan struct{}, send chan events.LRCEvent)
 			scrollViewportUp(false)
 		case 110:
 			setName()
+		case 74:
+			selectMsg(1)
+		case 75:
+			selectMsg(-1)
+		case 109:
+			toggleMuteSelected(send)
 		case 113:
 			close(quit)
 		case 114:
 			rerender()
+		case 117:
+			toggleRoster()
 		}
 	case name:
-		if buf[0] > 31 && buf[0] < 127 {
-			if len(cmdBuffer) < 12 {
-				cmdBuffer = cmdBuffer + string(buf[0])
-				renderPartialName()
-			}
-		} else if buf[0] == 127 {
-			if cmdBuffer != "" {
-				cmdBuffer = string(cmdBuffer[:len(cmdBuffer)-1])
-				renderPartialName()
-			}
-		} else if buf[0] == 10 || buf[0] == 13 {
-			setNameTo()
+		if buf[0] == 10 || buf[0] == 13 {
+			setNameTo(send)
+		} else {
+			typeIntoCmdBuffer(buf, 12)
+			renderPartialName()
 		}
 	case color:
-		if buf[0] > 31 && buf[0] < 127 {
-			if len(cmdBuffer) < 3 {
-				cmdBuffer = cmdBuffer + string(buf[0])
-				renderPartialColor()
-			}
-		} else if buf[0] == 127 {
-			if cmdBuffer != "" {
-				cmdBuffer = string(cmdBuffer[:len(cmdBuffer)-1])
-				renderPartialColor()
-			}
-		} else if buf[0] == 10 || buf[0] == 13 {
-			setMyColorTo()
+		if buf[0] == 10 || buf[0] == 13 {
+			setMyColorTo(send)
+		} else {
+			typeIntoCmdBuffer(buf, 3)
+			renderPartialColor()
 		}
 	}
 }
@@ -179,13 +208,15 @@ func setName() {
 	renderPartialName()
 }
 
-func setNameTo() {
-	if len(cmdBuffer) > 12 {
-		cmdBuffer = cmdBuffer[:12]
+// setNameTo sets my name to the cmdBuffer, and tells the server straight away if it can remember it
+func setNameTo(send chan events.Event) {
+	if utf8.RuneCountInString(cmdBuffer) > 12 {
+		cmdBuffer = string([]rune(cmdBuffer)[:12])
 	}
 	as.name = cmdBuffer
 	cmdBuffer = ""
 	cs = none
+	identify(send)
 	rerender()
 }
 
@@ -220,7 +251,8 @@ func renderPartialColor() {
 	renderPing(true)
 }
 
-func setMyColorTo() {
+// setMyColorTo sets my color to the cmdBuffer, and tells the server straight away if it can remember it
+func setMyColorTo(send chan events.Event) {
 	c, _ := strconv.Atoi(cmdBuffer)
 	if cmdBuffer == "" {
 		c = 15
@@ -228,6 +260,7 @@ func setMyColorTo() {
 	as.color = uint8(c)
 	cmdBuffer = ""
 	cs = none
+	identify(send)
 	rerender()
 }
 
@@ -236,65 +269,92 @@ func switchToChanInsert() {
 	renderHome(false)
 }
 
-func inputChanInsert(buf []byte, quit chan struct{}, send chan events.LRCEvent) {
-	if (buf[0] < 127) && (buf[0] > 31) {
-		if cursor == math.MaxUint16 {
-			cursor = 0
-			send <- events.GenInitEvent(as.color,as.name)
-			wordL = 0
-			initMyMsg(as.color, as.name)
-		}
-		send <- events.GenInsertEvent(cursor, string(buf[0]))
-		insertIntoMyMsg(cursor, string(buf[0]))
-		cursor = cursor + 1
-		wordL = wordL - 1
-
-	} else if buf[0] == 127 {
-		if cursor > 0 && cursor != math.MaxUint16 {
-			send <- events.GenDeleteEvent(cursor)
-			deleteFromMyMessage(cursor)
-			cursor = cursor - 1
-			wordL = wordL - 1
+// inputChanInsert types the printable characters in buf into my message, and handles backspace, ctrl-w, ctrl-u and enter.
+// Runs of characters, such as pastes, go out as a single insert if the server lets them
+func inputChanInsert(buf []byte, quit chan struct{}, send chan events.Event) {
+	if buf[0] == 27 {
+		switchToChanNormal()
+		return
+	}
+	run := ""
+	for _, r := range string(buf) {
+		if unicode.IsPrint(r) {
+			run = run + string(r)
+			continue
 		}
-	} else if buf[0] == 10 || buf[0] == 13 {
-		if cursor != math.MaxUint16 {
-			cursor = math.MaxUint16
-			send <- events.GenPubEvent()
-			pubMyMsg()
-			wordL = 0
+		typeIntoMyMsg(run, send)
+		run = ""
+		if r == 127 {
+			if cursor > 0 && cursor != math.MaxUint16 {
+				send <- &events.Delete{At: cursor}
+				deleteFromMyMessage(cursor)
+				cursor = cursor - 1
+				wordL = wordL - 1
+			}
+		} else if r == 21 {
+			deleteBackTo(0, send)
+		} else if r == 23 {
+			deleteBackTo(previousWordStart(), send)
+		} else if r == 10 || r == 13 {
+			if cursor != math.MaxUint16 {
+				cursor = math.MaxUint16
+				send <- &events.Pub{}
+				pubMyMsg()
+				wordL = 0
+			}
 		}
 	}
-	if buf[0] == 27 {
-		switchToChanNormal()
+	typeIntoMyMsg(run, send)
+}
+
+// deleteBackTo deletes everything in my message from idx up to the cursor as a single event
+func deleteBackTo(idx uint16, send chan events.Event) {
+	if cursor == math.MaxUint16 || idx >= cursor {
 		return
-		// if len(buf) == 1 || buf[1] == 0 {
+	}
+	n := cursor - idx
+	send <- &events.DeleteRange{At: idx, N: n}
+	deleteRangeFromMyMessage(idx, n)
+	cursor = idx
+	wordL = wordL - n
+}
 
-		// }
-		// switch buf[2] {
-		// case byte('A'): //up
-		// 	break
-		// 	if cursor != math.MaxUint16 {
-		// 		cursor = 0
-		// 	}
-		// case 'B': //down
-		// 	break
-		// 	if cursor != math.MaxUint16 {
-		// 		cursor = wordL
-		// 	}
-		// case 'C': //right
-		// 	break
-		// 	if cursor != wordL {
-		// 		cursor = cursor + 1
-		// 	}
-		// case 'D': //left
-		// 	break
-		// 	if cursor != 0 {
-		// 		cursor = cursor - 1
-		// 	}
-		// default:
-		// 	switchToChanNormal()
-		// }
+// previousWordStart returns the position where the word before the cursor starts, skipping any spaces between it and the cursor
+func previousWordStart() uint16 {
+	if cursor == math.MaxUint16 {
+		return cursor
+	}
+	fmtMu.Lock()
+	defer fmtMu.Unlock()
+	text := msgs[myMsgIdx].text
+	i := int(cursor)
+	for i > 0 && unicode.IsSpace(text[i-1]) {
+		i--
+	}
+	for i > 0 && !unicode.IsSpace(text[i-1]) {
+		i--
+	}
+	return uint16(i)
+}
+
+// typeIntoMyMsg inserts s at the cursor, initializing my message if I don't have one yet
+func typeIntoMyMsg(s string, send chan events.Event) {
+	if s == "" {
+		return
+	}
+	if cursor == math.MaxUint16 {
+		cursor = 0
+		// a server that remembers our identity fills in our color and name, so they don't need to be sent again
+		send <- &events.Init{Identified: caps.Has(events.CapIdentity), Color: as.color, Parent: replyTo, Name: as.name}
+		wordL = 0
+		initMyMsg(as.color, as.name, replyTo)
+		replyTo = 0
 	}
+	send <- &events.Insert{At: cursor, Text: s}
+	insertIntoMyMsg(cursor, s)
+	n := uint16(utf8.RuneCountInString(s))
+	cursor = cursor + n
+	wordL = wordL - n
 }
 
 func switchToChanNormal() {
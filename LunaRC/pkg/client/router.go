@@ -4,6 +4,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"time"
 	"weblrc"
 
@@ -12,6 +13,9 @@ import (
 
 var (
 	pingChannel = make(chan struct{})
+	version     = events.V1
+	caps        events.Caps
+	clientCaps  = events.CapMultiInsert | events.CapRangeEdit | events.CapErrors | events.CapHistory | events.CapTopic | events.CapThreads | events.CapPresence | events.CapIdentity | events.CapAbandon | events.CapSigned
 )
 
 type LRCCommand struct {
@@ -20,20 +24,50 @@ type LRCCommand struct {
 }
 
 // ConnectToChannel attempts to connect to a url, and if it succeeds, it sets up a listener, chatter, and pinger, and returns the connection
-func ConnectToChannel(url string, quit chan struct{}, send chan events.LRCEvent) *websocket.Conn {
-	conn, _, err := websocket.DefaultDialer.Dial("ws://localhost:927/ws", nil)
+func ConnectToChannel(url string, quit chan struct{}, send chan events.Event) *websocket.Conn {
+	scheme, server, room, err := splitURL(url)
 	if err != nil {
 		log.Fatal(err)
 	}
+	d, err := dialer(server)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, _, err := d.Dial(scheme+"://"+server+"/ws/"+room, authHeader(server))
+	if err != nil {
+		log.Fatal(err)
+	}
+	agreed, challenge := handshake(conn)
+	version, caps = agreed.Version, agreed.Caps
 
 	eventChan := make(chan []byte, 100)
 	go chat(conn, send)
 	go relayToParser(eventChan)
 	go listen(conn, eventChan)
 	go pinger(send)
+	prove(send, challenge, server)
+	identify(send)
 	return conn
 }
 
+// authHeader returns the header that carries our token for server, or nil if we don't have one
+func authHeader(server string) http.Header {
+	confMu.Lock()
+	defer confMu.Unlock()
+	token, ok := conf.Tokens[server]
+	if !ok {
+		return nil
+	}
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+// identify tells the server our nick and color, if it lets us set them once instead of in every init
+func identify(send chan events.Event) {
+	if caps.Has(events.CapIdentity) {
+		send <- &events.Identify{Color: as.color, Name: as.name}
+	}
+}
+
 func relayToParser(eventChan chan events.LRCEvent) {
 	for {
 		evt, ok := <-eventChan
@@ -42,18 +76,70 @@ func relayToParser(eventChan chan events.LRCEvent) {
 		}
 		addToCmdLog(evt)
 		parseCommand(evt)
+		refreshRoster()
 	}
 }
 
 
 
-func chat(conn *websocket.Conn, send chan []byte) {
+// handshake sends a hello, and waits for the server to answer it with the version and caps that we should speak.
+// Servers that don't know about hello answer it with a pong, in which case we stay on V1 without any caps.
+// If we agree on CapSigned, it also waits for the challenge that the server sends straight after its hello
+func handshake(conn *websocket.Conn) (events.Hello, *events.Challenge) {
+	agreed := events.Hello{Version: events.V1}
+	hello, _ := events.Frame(events.V1, &events.Ping{Hello: &events.Hello{Version: events.MaxVersion, Caps: clientCaps}})
+	err := conn.WriteMessage(websocket.BinaryMessage, hello)
+	if err != nil {
+		return agreed, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
 	for {
-		msg, ok := <-send
+		_, e, err := conn.ReadMessage()
+		if err != nil {
+			return agreed, nil
+		}
+		td, err := events.Unframe(agreed.Version, e)
+		if err != nil {
+			continue
+		}
+		_, evt, err := events.DecodeServerEvent(td)
+		if err != nil {
+			continue
+		}
+		switch evt := evt.(type) {
+		case *events.Ping:
+			if evt.Hello != nil {
+				agreed = *evt.Hello
+				if !agreed.Caps.Has(events.CapSigned) {
+					return agreed, nil
+				}
+				continue
+			}
+		case *events.Pong:
+			return agreed, nil
+		case *events.Challenge:
+			return agreed, evt
+		}
+		addToCmdLog(e)
+		parseCommand(e)
+	}
+}
+
+// chat downgrades the events that we send to the caps that we negotiated, frames them in the version that we negotiated, and writes them to the connection
+func chat(conn *websocket.Conn, send chan events.Event) {
+	for {
+		evt, ok := <-send
 		if !ok {
 			return
 		}
-		conn.WriteMessage(websocket.BinaryMessage, msg)
+		for _, de := range events.Downgrade(evt, caps) {
+			msg, err := events.Frame(version, de)
+			if err != nil {
+				continue
+			}
+			conn.WriteMessage(websocket.BinaryMessage, msg)
+		}
 	}
 }
 
@@ -73,29 +159,51 @@ func listen(conn *websocket.Conn, eventChan chan []byte) {
 }
 
 func parseCommand(e events.LRCEvent) {
-	e = e[1:]
-	switch events.ParseEventType(e) {
-	case events.EventPing:
-		if len([]byte(e)) > 5 {
-			setWelcomeMessage(string(e[5:]))
+	se, err := events.Unframe(version, e)
+	if err != nil {
+		return
+	}
+	id, evt, err := events.DecodeServerEvent(se)
+	if err != nil {
+		return
+	}
+	switch evt := evt.(type) {
+	case *events.Ping:
+		if evt.Welcome != "" {
+			setWelcomeMessage(evt.Welcome)
 		} else {
 			setWelcomeMessage("Fail")
 		}
-	case events.EventPong:
+	case *events.Pong:
 		go ponged()
-	case events.EventInit:
-		id, color, name, isFromMe := events.ParseInitEvent(e)
-		initMsg(id, color, name, true, isFromMe)
-	case events.EventPub:
-		pubMsg(events.ParsePubEvent(e))
-	case events.EventInsert:
-		insertIntoMsg(events.ParseInsertEvent(e))
-	case events.EventDelete:
-		deleteFromMessage(events.ParseDeleteEvent(e))
+	case *events.Init:
+		initMsg(id, evt.Color, evt.Name, true, evt.Echo, evt.Replay, evt.Parent, evt.Key)
+	case *events.Pub:
+		pubMsg(id)
+	case *events.Insert:
+		insertIntoMsg(id, evt.At, evt.Text)
+	case *events.Delete:
+		deleteFromMessage(id, evt.At)
+	case *events.DeleteRange:
+		deleteRangeFromMessage(id, evt.At, evt.N)
+	case *events.Replace:
+		replaceInMessage(id, evt.At, evt.N, evt.Text)
+	case *events.Error:
+		setWelcomeMessage("rejected: " + evt.Reason)
+	case *events.SetTopic:
+		setTopic(evt.Topic)
+	case *events.UserJoin:
+		userJoined(id, evt.Color, evt.Name)
+	case *events.UserLeave:
+		userLeft(id)
+	case *events.Abandon:
+		abandonMsg(id)
+	case *events.Verified:
+		userVerified(id, evt.Key)
 	}
 }
 
-func pinger(send chan events.LRCEvent) {
+func pinger(send chan events.Event) {
 	ticker := time.NewTicker(5 * time.Second)
 	defer ticker.Stop()
 	for {
@@ -104,11 +212,9 @@ func pinger(send chan events.LRCEvent) {
 	}
 }
 
-func ping(send chan events.LRCEvent) {
-	p := make([]byte, 2)
-	copy(p, events.ClientPing)
+func ping(send chan events.Event) {
 	t0 := time.Now()
-	send <- p
+	send <- &events.Ping{}
 	<-pingChannel
 	t1 := time.Now()
 	setPingTo(int(t1.Sub(t0).Milliseconds()))
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"weblrc"
+)
+
+// the badges shown after the names of users and messages that are from a key
+const (
+	badgeVerified = "✓" // badgeVerified is shown when the key is the one that was first seen with the name
+	badgeMismatch = "!" // badgeMismatch is shown when someone uses a name with a different key than the one it was first seen with
+)
+
+// myKey returns our key, generating it and saving it in the config the first time that it is needed
+func myKey() (ed25519.PrivateKey, error) {
+	confMu.Lock()
+	defer confMu.Unlock()
+	if conf.Key != "" {
+		seed, err := base64.StdEncoding.DecodeString(conf.Key)
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("the key in the config is not a base64 ed25519 seed")
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	conf.Key = base64.StdEncoding.EncodeToString(key.Seed())
+	return key, saveConfig()
+}
+
+// prove answers c by signing it with our key, as long as c is for server, which is the host and port that we connected to.
+// A challenge for another host could be a server relaying someone else's challenge, to sign in there as us
+func prove(send chan events.Event, c *events.Challenge, server string) {
+	if c == nil || !strings.EqualFold(c.Host, server) {
+		return
+	}
+	key, err := myKey()
+	if err != nil {
+		setWelcomeMessage(err.Error())
+		return
+	}
+	send <- &events.Prove{Key: key.Public().(ed25519.PublicKey), Sig: ed25519.Sign(key, c.Signed())}
+}
+
+// badgeFor returns the badge shown after name for a user or a message from key, which is empty if there is no key.
+// Keys are trusted on first use like certificates are, so the first key seen with a name is remembered, and later keys for that name are flagged
+func badgeFor(name string, key ed25519.PublicKey) string {
+	if key == nil {
+		return ""
+	}
+	if name == "" {
+		return badgeVerified
+	}
+	fp := base64.StdEncoding.EncodeToString(key)
+	confMu.Lock()
+	defer confMu.Unlock()
+	known, ok := conf.Known[name]
+	if !ok {
+		if conf.Known == nil {
+			conf.Known = make(map[string]string)
+		}
+		conf.Known[name] = fp
+		saveConfig()
+		return badgeVerified
+	}
+	if known != fp {
+		return badgeMismatch
+	}
+	return badgeVerified
+}
+
+// renderBadge prints badge, in green if it is verified and in red otherwise
+func renderBadge(badge string) {
+	if badge == badgeVerified {
+		setColor(2)
+	} else {
+		setColor(1)
+	}
+	fmt.Print(badge)
+	resetStyles()
+}
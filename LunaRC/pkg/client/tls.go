@@ -0,0 +1,105 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// defaultPort is the port that servers listen on when a url doesn't have one
+const defaultPort = "927"
+
+// splitURL splits url into its scheme, host and port, and room. Urls are like wss://moth11.net:927/proj, where everything but the host is optional.
+// The scheme is ws if there isn't one
+func splitURL(url string) (scheme string, host string, room string, err error) {
+	scheme, rest, ok := strings.Cut(url, "://")
+	if !ok {
+		scheme, rest = "ws", url
+	}
+	if scheme != "ws" && scheme != "wss" {
+		return "", "", "", fmt.Errorf("%q is not ws or wss", scheme)
+	}
+	host, room, _ = strings.Cut(rest, "/")
+	if host == "" {
+		return "", "", "", fmt.Errorf("%q doesn't have a host", url)
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, defaultPort)
+	}
+	return scheme, host, strings.Trim(room, "/"), nil
+}
+
+// dialer returns a dialer for server, which is its host and port. It trusts server if the system or the ca in the config vouch for it,
+// or if it presents the key that is pinned for it, and otherwise only if we have never connected to it before
+func dialer(server string) (*websocket.Dialer, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		roots = x509.NewCertPool()
+	}
+	confMu.Lock()
+	ca := conf.CA
+	confMu.Unlock()
+	if ca != "" {
+		pem, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s doesn't have any certificates in it", ca)
+		}
+	}
+	d := *websocket.DefaultDialer
+	d.TLSClientConfig = &tls.Config{
+		// the certificate is still verified, by verifyServer, which falls back to the pins when the roots don't vouch for it
+		InsecureSkipVerify: true,
+		VerifyConnection:   func(cs tls.ConnectionState) error { return verifyServer(cs, roots, server) },
+		MinVersion:         tls.VersionTLS12,
+	}
+	return &d, nil
+}
+
+// verifyServer accepts the server of cs if roots vouch for its certificate, or if its key matches the one pinned for the server.
+// The key is pinned whenever it is accepted, including when roots vouch for it, so a certificate that roots don't vouch for is only trusted on first use
+// for a server that we have never connected to. Otherwise a man in the middle of a server that roots vouch for could get its own certificate pinned
+func verifyServer(cs tls.ConnectionState, roots *x509.CertPool, server string) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("the server didn't present a certificate")
+	}
+	leaf := cs.PeerCertificates[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{DNSName: cs.ServerName, Roots: roots, Intermediates: intermediates})
+
+	fp := fingerprint(leaf)
+	confMu.Lock()
+	defer confMu.Unlock()
+	pinned, known := conf.Pins[server]
+	if err != nil && known && pinned != fp {
+		path, _ := configPath()
+		return fmt.Errorf("the certificate of %s is not the one that was pinned, and it isn't trusted otherwise (%w). if it was replaced on purpose, remove its pin from %s", server, err, path)
+	}
+	if pinned == fp {
+		return nil
+	}
+	if conf.Pins == nil {
+		conf.Pins = make(map[string]string)
+	}
+	conf.Pins[server] = fp
+	return saveConfig()
+}
+
+// fingerprint returns the sha256 of cert's public key, so that pins survive certificates being renewed with the same key
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,91 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newCert returns a certificate for localhost signed by parent, or self signed if parent is nil, along with its key
+func newCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestVerifyServer(t *testing.T) {
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	confMu.Lock()
+	conf = clientConfig{}
+	confMu.Unlock()
+
+	ca, caKey := newCert(t, nil, nil, true)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	trusted, _ := newCert(t, ca, caKey, false)
+	renewed, _ := newCert(t, ca, caKey, false)
+	mitm, _ := newCert(t, nil, nil, false)
+	other, _ := newCert(t, nil, nil, false)
+	state := func(cert *x509.Certificate) tls.ConnectionState {
+		return tls.ConnectionState{ServerName: "localhost", PeerCertificates: []*x509.Certificate{cert}}
+	}
+
+	for _, step := range []struct {
+		name   string
+		cert   *x509.Certificate
+		server string
+		ok     bool
+	}{
+		{"vouched for", trusted, "localhost:927", true},
+		{"man in the middle of a vouched for server", mitm, "localhost:927", false},
+		{"renewed with a new key", renewed, "localhost:927", true},
+		{"old key after renewal", mitm, "localhost:927", false},
+		{"first use", mitm, "localhost:928", true},
+		{"pinned", mitm, "localhost:928", true},
+		{"another key for a pinned server", other, "localhost:928", false},
+		{"vouched for after a pin", trusted, "localhost:928", true},
+		{"pinned key after a vouched for one", mitm, "localhost:928", false},
+	} {
+		err := verifyServer(state(step.cert), roots, step.server)
+		if (err == nil) != step.ok {
+			t.Errorf("%s: got %v", step.name, err)
+		}
+	}
+	confMu.Lock()
+	defer confMu.Unlock()
+	if conf.Pins["localhost:927"] != fingerprint(renewed) || conf.Pins["localhost:928"] != fingerprint(trusted) {
+		t.Errorf("pins are %v", conf.Pins)
+	}
+}
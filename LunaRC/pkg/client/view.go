@@ -1,11 +1,17 @@
 package client
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"golang.org/x/term"
+	"log"
 	"weblrc"
+	"math"
 	"os"
+	"slices"
+	"strings"
 	"sync"
+	"unicode/utf8"
 )
 
 var (
@@ -17,14 +23,21 @@ var (
 	fmtMu      sync.Mutex
 	cmdLog     []events.LRCEvent
 	myMsgIdx   int
+	selected   = -1                    // selected is the index of the message that mute and reply act on, or -1 if none is selected
+	mutedVia   = make(map[uint32]bool) // mutedVia holds the ids of the messages whose authors we muted
+	replyTo    uint32                  // replyTo is the id of the message that my next message replies to, or 0 if it doesn't reply
 )
 
+// maxDepth is how deep replies are indented, so that long threads still leave room for names
+const maxDepth = 3
+
 type appState struct {
 	url     string
 	welcome string
 	ping    int
 	color   uint8
 	name    string
+	topic   string
 }
 
 type terminalState struct {
@@ -32,19 +45,28 @@ type terminalState struct {
 	h              int
 	viewportTop    int
 	viewportBottom int
-	cpl            int //characters per line
+	cpl            int //columns per line
 }
 
 type user struct {
-	c    uint8
-	name string
+	c     uint8
+	name  string
+	key   ed25519.PublicKey // key is the key that the user proved that they hold, if they did
+	badge string            // badge is shown after the name, and is empty if the user has no key
 }
 
+// message is a message from a user. Its text is held as runes, since positions in LRC count runes
 type message struct {
-	user   *user
-	text   string
-	active bool
-	absPos int
+	user    *user
+	text    []rune
+	active  bool
+	absPos  int
+	replay  bool   // replay is set for messages that were published before we joined, which are drawn faint
+	dropped bool   // dropped is set for messages that were abandoned instead of published, which are also drawn faint
+	id      uint32 // id is the id the server gave the message, or 0 until the server echoes our own messages
+	mine    bool
+	parent  *message // parent is the message that this one replies to, if we have it
+	depth   int      // depth is how many replies deep the message is, up to maxDepth
 }
 
 type line struct {
@@ -80,11 +102,19 @@ func initChan() {
 	clearAll()
 	renderHome(true)
 	lines = make([]line, 0)
+	clear(roster)
 }
 
-// TODO store and read from file
+// TODO store and read the rest from file
 func recallApplicationState() {
-	as = appState{"moth11.net", as.welcome, 0, 13, "wanderer"}
+	err := loadConfig()
+	if err != nil {
+		log.Fatal("failed to read the config: ", err)
+	}
+	as = appState{"moth11.net", as.welcome, 0, 13, "wanderer", ""}
+	if conf.URL != "" {
+		as.url = conf.URL
+	}
 }
 
 func getTerminalSize() {
@@ -93,6 +123,9 @@ func getTerminalSize() {
 		panic(err)
 	}
 	ts = terminalState{width, height, 0, height - 1, width - 13}
+	if rosterShown() {
+		ts.cpl -= rosterW
+	}
 }
 
 func resize(resizeChan chan struct{}) {
@@ -105,13 +138,16 @@ func resize(resizeChan chan struct{}) {
 	}
 }
 
-// TODO recalculate line breaks on change width
+// fixAfterResize redraws the splash, or lays out the channel again, since line breaks depend on the width
 func fixAfterResize() {
+	fmtMu.Lock()
+	defer fmtMu.Unlock()
+
 	if is == menuInsert || is == menuNormal {
 		cursorHome()
 		renderSplash()
 	} else {
-		rerender()
+		relayout()
 	}
 }
 
@@ -131,7 +167,26 @@ func setWelcomeMessage(s string) {
 }
 
 func spaceForWelcome() bool {
-	return (14 + len(as.welcome) + len(as.url)) <= ts.w
+	return (14 + utf8.RuneCountInString(as.welcome) + utf8.RuneCountInString(as.url)) <= ts.w
+}
+
+// setTopic sets the topic of the room, and rerenders the bottom row since a shorter topic has to clear what was left of the longer one
+func setTopic(s string) {
+	as.topic = s
+	renderHome(false)
+}
+
+// visibleTopic returns as much of the topic as fits between the url and the welcome message, cut short with an ellipsis if it doesn't all fit
+func visibleTopic() string {
+	space := ts.w - 16 - utf8.RuneCountInString(as.welcome) - utf8.RuneCountInString(as.url)
+	topic := []rune(as.topic)
+	if len(topic) <= space {
+		return as.topic
+	}
+	if space < 4 {
+		return ""
+	}
+	return string(topic[:space-1]) + "…"
 }
 
 func homeStyle() {
@@ -163,12 +218,26 @@ func renderWelcomeMessage(alreadyLocked bool) {
 		defer fmtMu.Unlock()
 	}
 
-	cursorGoto(ts.h, ts.w-5-len(as.welcome))
+	cursorGoto(ts.h, ts.w-5-utf8.RuneCountInString(as.welcome))
 	homeStyle()
 	fmt.Print(as.welcome)
 	resetStyles()
 }
 
+// renderTopic renders the topic in the bottom middle, just left of the welcome message
+func renderTopic(alreadyLocked bool) {
+	if !alreadyLocked {
+		fmtMu.Lock()
+		defer fmtMu.Unlock()
+	}
+
+	topic := visibleTopic()
+	cursorGoto(ts.h, ts.w-7-utf8.RuneCountInString(as.welcome)-utf8.RuneCountInString(topic))
+	homeStyle()
+	fmt.Print(topic)
+	resetStyles()
+}
+
 // renderUrl renders the url, with the protocol that the connection is occuring over
 func renderUrl(alreadyLocked bool) {
 	if !alreadyLocked {
@@ -177,7 +246,11 @@ func renderUrl(alreadyLocked bool) {
 	}
 
 	homeStyle()
-	fmt.Printf("lrc://%s/", as.url)
+	if strings.Contains(as.url, "://") {
+		fmt.Printf("%s/", as.url)
+	} else {
+		fmt.Printf("lrc://%s/", as.url)
+	}
 	resetStyles()
 }
 
@@ -196,6 +269,9 @@ func renderHome(alreadyLocked bool) {
 	if spaceForWelcome() {
 		renderWelcomeMessage(true)
 	}
+	if spaceForWelcome() && as.topic != "" {
+		renderTopic(true)
+	}
 	renderPing(true)
 	if is == chanInsert {
 		cursorBar()
@@ -210,6 +286,11 @@ func rerender() {
 	fmtMu.Lock()
 	defer fmtMu.Unlock()
 
+	redraw()
+}
+
+// redraw rerenders every line in viewport, and must be called with fmtMu held
+func redraw() {
 	clearAll()
 	cursorHome()
 	for idx := 1; idx < ts.h; idx++ {
@@ -219,16 +300,17 @@ func rerender() {
 		cursorGoto(idx, 1)
 		renderLine(lines[idx-1+ts.viewportTop])
 	}
+	renderRoster(true)
 	renderHome(true)
 }
 
-// lcount counts how many lines are in a message, 1-indexed
+// lcount counts how many lines are in a message, 1-indexed. A message whose last line is exactly full doesn't have a line after it yet
 func (m *message) lCount() int {
-	return len(m.text)/ts.cpl + 1
+	return len(m.layout())
 }
 
 // initMSg initializes a message from a user, and renders the initial line.
-func initMsg(id uint32, color uint8, name string, alreadyLocked bool, isFromMe bool) {
+func initMsg(id uint32, color uint8, name string, alreadyLocked bool, isFromMe bool, replay bool, parent uint32, key ed25519.PublicKey) {
 	if !alreadyLocked {
 		fmtMu.Lock()
 		defer fmtMu.Unlock()
@@ -236,32 +318,100 @@ func initMsg(id uint32, color uint8, name string, alreadyLocked bool, isFromMe b
 
 	if isFromMe {
 		idToMsgIdx[id] = -1
+		if myMsgIdx < len(msgs) && msgs[myMsgIdx].mine && msgs[myMsgIdx].id == 0 {
+			msgs[myMsgIdx].id = id
+		}
 		return
 	}
 
-	idToMsgIdx[id] = len(msgs)
-	initAMsg(color, name)
+	idToMsgIdx[id] = initAMsg(&message{id: id, replay: replay}, color, name, parent, key)
 }
 
-func initMyMsg(color uint8, name string) {
+func initMyMsg(color uint8, name string, parent uint32) {
 	fmtMu.Lock()
 	defer fmtMu.Unlock()
 
-	myMsgIdx = len(msgs)
-	initAMsg(color, name)
-}
-
-func initAMsg(color uint8, name string) {
-	u := user{color, name}
-	abs := 0
+	myMsgIdx = initAMsg(&message{mine: true}, color, name, parent, nil)
+}
+
+// initAMsg initializes m from key and renders its first line, and returns its index. Replies go under the last message in their parent's thread, and everything else goes at the end
+func initAMsg(m *message, color uint8, name string, parent uint32, key ed25519.PublicKey) int {
+	m.user = &user{c: color, name: name, key: key, badge: badgeFor(name, key)}
+	m.active = true
+	if parent != 0 {
+		m.depth = 1
+		if pi := msgIdxOf(parent); pi >= 0 {
+			m.parent = msgs[pi]
+			m.depth = min(msgs[pi].depth+1, maxDepth)
+			if k := endOfThread(pi); k < len(msgs) {
+				insertAMsgAt(k, m)
+				return k
+			}
+		}
+	}
 	if len(msgs) != 0 {
 		pm := msgs[len(msgs)-1]
-		abs = pm.absPos + pm.lCount()
+		m.absPos = pm.absPos + pm.lCount()
 	}
-	m := message{&u, "", true, abs}
-	l := line{&m, 0}
-	msgs = append(msgs, &m)
-	appendAndRender(l)
+	msgs = append(msgs, m)
+	appendAndRender(line{m, 0})
+	return len(msgs) - 1
+}
+
+// msgIdxOf returns the index of the message with id, including my own once the server has echoed them, or -1 if there isn't one
+func msgIdxOf(id uint32) int {
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// endOfThread returns the index just after the last message in the thread of the message at pi, which is where a new reply to it goes
+func endOfThread(pi int) int {
+	k := pi + 1
+	for k < len(msgs) && repliesTo(msgs[k], msgs[pi]) {
+		k++
+	}
+	return k
+}
+
+// repliesTo returns true if m is a reply to p, or a reply to one of its replies
+func repliesTo(m *message, p *message) bool {
+	for a := m.parent; a != nil; a = a.parent {
+		if a == p {
+			return true
+		}
+	}
+	return false
+}
+
+// insertAMsgAt inserts m before the message at k, then lays out the lines after it again and redraws the viewport.
+// If the viewport was following the last line, it keeps following it
+func insertAMsgAt(k int, m *message) {
+	following := viewportFull()
+	msgs = slices.Insert(msgs, k, m)
+	for id, i := range idToMsgIdx {
+		if i >= k {
+			idToMsgIdx[id] = i + 1
+		}
+	}
+	if myMsgIdx >= k {
+		myMsgIdx++
+	}
+	if selected >= k {
+		selected++
+	}
+	pm := msgs[k-1]
+	m.absPos = pm.absPos + pm.lCount()
+	lines = slices.Insert(lines, m.absPos, line{m, 0})
+	updateAbsoluteLineNumbersAfter(k, 1)
+	if following {
+		ts.viewportTop++
+		ts.viewportBottom++
+	}
+	redraw()
 }
 
 // appendAndRender is called whenever a new line is appended to the end of lines
@@ -316,6 +466,21 @@ func pubMsg(id uint32) {
 	pubAMsg(mi)
 }
 
+// abandonMsg ends the message with id without publishing it, and greys it out
+func abandonMsg(id uint32) {
+	fmtMu.Lock()
+	defer fmtMu.Unlock()
+
+	mi, ok := idToMsgIdx[id]
+	if !ok || mi < 0 {
+		return
+	}
+	m := msgs[mi]
+	m.active = false
+	m.dropped = true
+	renderAMsg(m)
+}
+
 func pubMyMsg() {
 	fmtMu.Lock()
 	defer fmtMu.Unlock()
@@ -326,6 +491,11 @@ func pubMyMsg() {
 func pubAMsg(mi int) {
 	m := msgs[mi]
 	m.active = false
+	renderAMsg(m)
+}
+
+// renderAMsg renders every line of m that is in the viewport
+func renderAMsg(m *message) {
 	fliv := findFLInViewport(m)
 	if fliv == -1 {
 		return
@@ -416,7 +586,7 @@ func insertIntoMsg(id uint32, idx uint16, s string) {
 
 	mi, exists := idToMsgIdx[id]
 	if !exists {
-		initMsg(id, 66, "???", true, false)
+		initMsg(id, 66, "???", true, false, false, 0, nil)
 		mi = idToMsgIdx[id]
 	}
 	if mi < 0 {
@@ -434,13 +604,21 @@ func insertIntoMyMsg(idx uint16, s string) {
 	insertIntoAMsg(mi, idx, s)
 }
 
+// insertIntoAMsg inserts s into the message at mi one rune at a time, since the rendering logic only knows how to move one character
 func insertIntoAMsg(mi int, idx uint16, s string) {
+	for _, r := range s {
+		insertRuneIntoAMsg(mi, idx, string(r))
+		idx++
+	}
+}
+
+func insertRuneIntoAMsg(mi int, idx uint16, s string) {
 	m := msgs[mi]
 	l := len(m.text)
 	if l == int(idx) {
 		appendTo(m, s, mi)
 	} else if l > int(idx) {
-		insertInto(m, idx, s, mi)
+		spliceAMsg(mi, int(idx), 0, s)
 	} else {
 		lateInsertInto(m, idx, s, mi)
 	}
@@ -452,7 +630,7 @@ func deleteFromMessage(id uint32, idx uint16) {
 
 	mi, exists := idToMsgIdx[id]
 	if !exists {
-		initMsg(id, 66, "???", true, false)
+		initMsg(id, 66, "???", true, false, false, 0, nil)
 		mi = idToMsgIdx[id]
 	}
 	if mi < 0 {
@@ -470,14 +648,87 @@ func deleteFromMyMessage(idx uint16) {
 	deleteFromAMessage(mi, idx)
 }
 
+// deleteFromAMessage deletes the rune before idx in the message at mi
 func deleteFromAMessage(mi int, idx uint16) {
 	m := msgs[mi]
 	l := len(m.text)
+	if idx == 0 {
+		return
+	}
 	if l == int(idx) {
 		truncFrom(m, mi)
 	} else if l > int(idx) {
+		spliceAMsg(mi, int(idx)-1, 1, "")
+	}
+}
+
+func deleteRangeFromMessage(id uint32, idx uint16, n uint16) {
+	fmtMu.Lock()
+	defer fmtMu.Unlock()
+
+	mi, exists := idToMsgIdx[id]
+	if !exists || mi < 0 {
+		return
+	}
+
+	deleteRangeFromAMessage(mi, idx, n)
+}
+
+func deleteRangeFromMyMessage(idx uint16, n uint16) {
+	fmtMu.Lock()
+	defer fmtMu.Unlock()
 
+	deleteRangeFromAMessage(myMsgIdx, idx, n)
+}
+
+// deleteRangeFromAMessage deletes n runes starting at idx in the message at mi. Ranges at the end of the message are truncated one rune at a time, which renders incrementally
+func deleteRangeFromAMessage(mi int, idx uint16, n uint16) {
+	m := msgs[mi]
+	l := len(m.text)
+	end := int(idx) + int(n)
+	if n == 0 || end > l {
+		return
 	}
+	if end == l {
+		for range n {
+			truncFrom(m, mi)
+		}
+		return
+	}
+	spliceAMsg(mi, int(idx), int(n), "")
+}
+
+func replaceInMessage(id uint32, idx uint16, n uint16, s string) {
+	fmtMu.Lock()
+	defer fmtMu.Unlock()
+
+	mi, exists := idToMsgIdx[id]
+	if !exists || mi < 0 {
+		return
+	}
+
+	deleteRangeFromAMessage(mi, idx, n)
+	insertIntoAMsg(mi, idx, s)
+}
+
+// spliceAMsg replaces n runes at idx of the message at mi with s, then lays out the lines of the message again and redraws the viewport.
+// Edits in the middle of a message move every character after them, so they are not worth rendering incrementally
+func spliceAMsg(mi int, idx int, n int, s string) {
+	m := msgs[mi]
+	before := m.lCount()
+	m.text = slices.Replace(m.text, idx, idx+n, []rune(s)...)
+	after := m.lCount()
+	if after > before {
+		nls := make([]line, 0, after-before)
+		for ln := before; ln < after; ln++ {
+			nls = append(nls, line{m, ln})
+		}
+		lines = slices.Insert(lines, m.absPos+before, nls...)
+	} else if after < before {
+		lines = slices.Delete(lines, m.absPos+after, m.absPos+before)
+	}
+	updateAbsoluteLineNumbersAfter(mi, after-before)
+	redraw()
 }
 
 func connectionFailure(to string, err error) {
@@ -488,3 +739,63 @@ func connectionFailure(to string, err error) {
 	fmt.Print("\r\n" + err.Error())
 	panic(err)
 }
+
+// selectMsg moves the selection by messages, starting from the last message if none is selected, and clears it if it moves past the last message
+func selectMsg(by int) {
+	fmtMu.Lock()
+	defer fmtMu.Unlock()
+
+	if len(msgs) == 0 {
+		return
+	}
+	prev := selected
+	if selected < 0 {
+		if by > 0 {
+			return
+		}
+		selected = len(msgs)
+	}
+	selected = max(selected+by, 0)
+	if selected >= len(msgs) {
+		selected = -1
+	}
+	if prev >= 0 {
+		renderAMsg(msgs[prev])
+	}
+	if selected >= 0 {
+		renderAMsg(msgs[selected])
+	}
+}
+
+// toggleMuteSelected mutes the author of the selected message, or unmutes them if they were muted through it
+func toggleMuteSelected(send chan events.Event) {
+	fmtMu.Lock()
+	if selected < 0 || msgs[selected].id == 0 || msgs[selected].mine {
+		fmtMu.Unlock()
+		return
+	}
+	id, name := msgs[selected].id, msgs[selected].user.name
+	fmtMu.Unlock()
+
+	if mutedVia[id] {
+		delete(mutedVia, id)
+		send <- &events.UnmuteUser{ID: id}
+		setWelcomeMessage("unmuted " + name)
+		return
+	}
+	mutedVia[id] = true
+	send <- &events.MuteUser{ID: id}
+	setWelcomeMessage("muted " + name)
+}
+
+// replyToSelected switches to insert mode, where the message I type next replies to the selected message.
+// If I'm already typing a message, it stays whatever it was
+func replyToSelected() {
+	fmtMu.Lock()
+	if selected >= 0 && cursor == math.MaxUint16 {
+		replyTo = msgs[selected].id
+	}
+	fmtMu.Unlock()
+	switchToChanInsert()
+	cursorHome()
+}
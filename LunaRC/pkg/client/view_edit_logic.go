@@ -6,27 +6,29 @@ import (
 	"strings"
 )
 
+// appendTo appends the rune s to m, which starts a new line if s doesn't fit in what is left of the last one
 func appendTo(m *message, s string, mi int) {
-	if !overflowing(m) {
-		if lastLineInViewport(m) {
+	ln, _ := landing(m, s)
+	if ln < m.lCount() {
+		if lineInViewport(m, ln) {
 			appendInLineInViewport(m, s)
 		} else {
 			appendInLineNotInViewport(m, s)
 		}
 	} else if isLast(m) {
-		if lastLineJustInViewport(m) {
+		if lineJustInViewport(m, ln) {
 			appendEndOfAllLinesJustInViewport(m, s)
-		} else if lastLineInViewport(m) {
+		} else if lineInViewport(m, ln) {
 			appendEndOfAllLinesInViewport(m, s)
 		} else {
 			appendEndOfAllLinesBelowViewport(m, s)
 		}
 	} else {
-		if lastLineJustInViewport(m) {
+		if lineJustInViewport(m, ln) {
 			appendEndOfLineJustInViewport(m, s, mi)
-		} else if lastLineInViewport(m) {
+		} else if lineInViewport(m, ln) {
 			appendEndOfLineInViewport(m, s, mi)
-		} else if lastLineAboveViewport(m) {
+		} else if lineAboveViewport(m, ln) {
 			appendEndOfLineAboveViewport(m, s, mi)
 		} else {
 			appendEndOfLineBelowViewport(m, s, mi)
@@ -34,24 +36,28 @@ func appendTo(m *message, s string, mi int) {
 	}
 }
 
+// landing returns the line and column of m that s is drawn at if it is appended
+func landing(m *message, s string) (ln int, col int) {
+	return position(append(slices.Clip(m.text), []rune(s)...), len(m.text))
+}
+
 // appendInLineNotInViewport appends s to an m whose final line is both incomplete and not currently in the viewport
 func appendInLineNotInViewport(m *message, s string) {
-	m.text = m.text + s
+	m.text = append(m.text, []rune(s)...)
 }
 
 // appendInLineInViewport appends s to an m whose final line is both incomplete and currently in the viewport. Renders the change
 func appendInLineInViewport(m *message, s string) {
-	l := len(m.text)
-	cursorGoto(findAbsoluteLineNumberOf(m, l/ts.cpl)-ts.viewportTop, 14+l%ts.cpl)
-	appendToLine(line{m, l / ts.cpl}, s)
-	m.text = m.text + s
+	ln, col := landing(m, s)
+	cursorGoto(findAbsoluteLineNumberOf(m, ln)-ts.viewportTop, 14+col)
+	appendToLine(line{m, ln}, s)
+	m.text = append(m.text, []rune(s)...)
 }
 
 // appendEndOfAllLinesInViewport appends s to an m which is the last message and whose final line is complete, and which is in viewport. Renders the change
 func appendEndOfAllLinesInViewport(m *message, s string) {
-	l := len(m.text)
-	m.text = m.text + s
-	nln := l / ts.cpl
+	nln := m.lCount()
+	m.text = append(m.text, []rune(s)...)
 	nl := line{m, nln}
 	lines = append(lines, nl)
 	cursorGoto(findAbsoluteLineNumberOf(m, nln)-ts.viewportTop, 1)
@@ -66,9 +72,8 @@ func appendEndOfAllLinesJustInViewport(m *message, s string) {
 
 // appendEndOfAllLinesBelowViewport apppends s to an m which is the last message and whose final line is complete, and which is below the viewport
 func appendEndOfAllLinesBelowViewport(m *message, s string) {
-	l := len(m.text)
-	m.text = m.text + s
-	nln := l / ts.cpl
+	nln := m.lCount()
+	m.text = append(m.text, []rune(s)...)
 	nl := line{m, nln}
 	lines = append(lines, nl)
 }
@@ -82,9 +87,8 @@ func appendEndOfLineAboveViewport(m *message, s string, mi int) {
 
 // appendEndOfLineInViewport appends s to an m which is not the last message and whose final line is complete, and which is in the viewport. Renders the change and updates all absolute line numbers of messages after mi
 func appendEndOfLineInViewport(m *message, s string, mi int) {
-	l := len(m.text)
-	m.text = m.text + s
-	nln := l / ts.cpl
+	nln := m.lCount()
+	m.text = append(m.text, []rune(s)...)
 	nl := line{m, nln}
 	nlan := nln + m.absPos
 	lines = slices.Insert(lines, nlan, nl)
@@ -113,9 +117,8 @@ func appendEndOfLineBelowViewport(m *message, s string, mi int) {
 }
 
 func appendEndOfLine(m *message, s string, mi int) {
-	l := len(m.text)
-	m.text = m.text + s
-	nln := l / ts.cpl
+	nln := m.lCount()
+	m.text = append(m.text, []rune(s)...)
 	nl := line{m, nln}
 	lines = slices.Insert(lines, m.absPos+nln, nl)
 	updateAbsoluteLineNumbersAfter(mi, 1)
@@ -158,28 +161,29 @@ func insertInto(m *message, i uint16, s string, mi int) {
 // insertInLastLineNotInViewport inserts s at i in an m which is the last line of its m and which is not in viewport
 func insertInLastLineNotInViewport(m *message, i uint16, s string) {
 	return
-	m.text = m.text[:int(i)] + s + m.text[int(i):]
+	m.text = slices.Insert(m.text, int(i), []rune(s)...)
 }
 
 // insertInLastLineInViewport inserts s at i in an m which is the last line of its m and which is in viewport. Renders the change
 func insertInLastLineInViewport(m *message, i uint16, s string) {
 	return
-	l := lines[m.absPos+len(m.text)/ts.cpl]
-	m.text = m.text[:int(i)] + s + m.text[int(i):]
-	cursorGoto(findAbsoluteLineNumberOf(m, int(i)/ts.cpl)-ts.viewportTop, 14+int(i)%ts.cpl)
+	l := lines[m.absPos+m.endLine()]
+	m.text = slices.Insert(m.text, int(i), []rune(s)...)
+	ln, col := position(m.text, int(i))
+	cursorGoto(findAbsoluteLineNumberOf(m, ln)-ts.viewportTop, 14+col)
 	insertIntoLine(l, s)
 }
 
 // insertInNotLastLineNotInViewport inserts s at i in an m where i is not in the last line of its m and which is not in viewport
 func insertInNotLastLineNotInViewport(m *message, i uint16, s string) {
 	return
-	m.text = m.text[:int(i)] + s + m.text[int(i):]
+	m.text = slices.Insert(m.text, int(i), []rune(s)...)
 }
 
 // insertInNotLastLineAffectingViewport inserts s at i in an m where i is not in the last line of its m which is not in viewport, but m has at least one line in viewport. Renders the change
 func insertInNotLastLineAffectingViewport(m *message, i uint16, s string) {
 	return
-	m.text = m.text[:int(i)] + s + m.text[int(i):]
+	m.text = slices.Insert(m.text, int(i), []rune(s)...)
 	for idx := ts.viewportTop; isALineOf(idx, m); idx++ {
 		c := lineFirst(lines[idx])
 		cursorGoto(idx-ts.viewportTop+1, 14)
@@ -197,10 +201,11 @@ func isALineOf(idx int, m *message) bool {
 // insertInNotLastLineInViewport inserts s at i in an m where i is not in the last line of its m which is in viewport (the m is not necessarily entirely contained in the viewport). Renders the chagne
 func insertInNotLastLineInViewport(m *message, i uint16, s string) {
 	return
-	fi := m.absPos + len(m.text)/ts.cpl
+	fi := m.absPos + m.endLine()
 	l := lines[fi]
-	m.text = m.text[:int(i)] + s + m.text[int(i):]
-	cursorGoto(findAbsoluteLineNumberOf(m, int(i)/ts.cpl)-ts.viewportTop, 14+int(i)%ts.cpl)
+	m.text = slices.Insert(m.text, int(i), []rune(s)...)
+	ln, col := position(m.text, int(i))
+	cursorGoto(findAbsoluteLineNumberOf(m, ln)-ts.viewportTop, 14+col)
 	insertIntoLine(l, s)
 	for idx := fi; isALineOf(idx, m); idx++ {
 		c := lineFirst(lines[idx])
@@ -212,8 +217,8 @@ func insertInNotLastLineInViewport(m *message, i uint16, s string) {
 // insertOverflowingAboveViewport inserts s at i in an m that is currently full and which has no lines in viewport
 func insertOverflowingAboveViewport(m *message, i uint16, s string, mi int) {
 	return
-	m.text = m.text[:int(i)] + s + m.text[int(i):]
-	os := len(m.text) / ts.cpl
+	m.text = slices.Insert(m.text, int(i), []rune(s)...)
+	os := m.endLine()
 	lli := m.absPos + os
 	nll := line{m, os}
 	lines = slices.Insert(lines, lli, nll)
@@ -225,8 +230,8 @@ func insertOverflowingAboveViewport(m *message, i uint16, s string, mi int) {
 // insertOverflowingAffectingViewport inserts s at i in an m that is currently full and which has at least one line in viewport, but i is not in viewport. Renders the change
 func insertOverflowingAffectingViewport(m *message, i uint16, s string, mi int) {
 	return
-	m.text = m.text[:int(i)] + s + m.text[int(i):]
-	os := len(m.text) / ts.cpl
+	m.text = slices.Insert(m.text, int(i), []rune(s)...)
+	os := m.endLine()
 	lli := m.absPos + os
 	nll := line{m, os}
 	if mi == len(lines)-1 {
@@ -249,8 +254,8 @@ func insertOverflowingAffectingViewport(m *message, i uint16, s string, mi int)
 // insertOverflowingInViewport inserts s at i in an m that is currently full and where i is in viewport (the m is not necessarily entirely contained within viewport). Renders the change
 func insertOverflowingInViewport(m *message, i uint16, s string, mi int) {
 	return
-	m.text = m.text[:int(i)] + s + m.text[int(i):]
-	os := len(m.text) / ts.cpl
+	m.text = slices.Insert(m.text, int(i), []rune(s)...)
+	os := m.endLine()
 	lli := m.absPos + os
 	nll := line{m, os}
 	if mi == len(msgs)-1 {
@@ -260,7 +265,8 @@ func insertOverflowingInViewport(m *message, i uint16, s string, mi int) {
 		lines = slices.Insert(lines, lli, nll)
 		updateAbsoluteLineNumbersAfter(mi, 1)
 	}
-	for idx := m.absPos + int(i)/ts.cpl; isALineOf(idx-1+ts.viewportTop, m); idx++ {
+	il, _ := position(m.text, int(i))
+	for idx := m.absPos + il; isALineOf(idx-1+ts.viewportTop, m); idx++ {
 		l := lines[idx]
 		cursorGoto(idx, 14)
 		insertIntoLine(l, lineFirst(l))
@@ -270,8 +276,8 @@ func insertOverflowingInViewport(m *message, i uint16, s string, mi int) {
 // insertOverflowingJustInViewport inserts s at i in an m that is currently full and where i is in a just full viewport (the m is not necessarily entirely contained within viewport). Renders the change
 func insertOverflowingJustInViewport(m *message, i uint16, s string, mi int) {
 	return
-	m.text = m.text[:int(i)] + s + m.text[int(i):]
-	os := len(m.text) / ts.cpl
+	m.text = slices.Insert(m.text, int(i), []rune(s)...)
+	os := m.endLine()
 	lli := m.absPos + os
 	nll := line{m, os}
 	if mi == len(lines)-1 {
@@ -297,16 +303,14 @@ func insertOverflowingBelowViewport(m *message, i uint16, s string) {
 
 // TODO
 func lateInsertInto(m *message, i uint16, s string, mi int) {
-	cl := len(m.text)
-	nl := int(i)
-	clc := cl / ts.cpl
-	nlc := nl / ts.cpl
-	m.text += strings.Repeat(" ", nl-cl)
+	clc := m.lCount()
+	m.text = append(m.text, []rune(strings.Repeat(" ", int(i)-len(m.text)))...)
+	nlc := m.lCount()
 	cursorGoto(m.absPos-ts.viewportTop+1, 1)
 	renderLine(lines[m.absPos])
 	if clc != nlc {
 		if mi == len(msgs)-1 {
-			for ln := clc + 1; ln <= nlc; ln++ {
+			for ln := clc; ln < nlc; ln++ {
 				l := line{m, ln}
 				lines = append(lines, l)
 				cursorGoto(m.absPos-ts.viewportTop+1+ln, 1)
@@ -315,7 +319,7 @@ func lateInsertInto(m *message, i uint16, s string, mi int) {
 		} else {
 			return //should only be reachable with inserts, which are currently unimplemented
 			ls := make([]line, 0, nlc-clc)
-			for ln := clc + 1; ln <= nlc; ln++ {
+			for ln := clc; ln < nlc; ln++ {
 				ls = append(ls, line{m, ln})
 			}
 			lines = slices.Insert(lines, m.absPos+clc, ls...)
@@ -324,27 +328,29 @@ func lateInsertInto(m *message, i uint16, s string, mi int) {
 	appendTo(m, s, mi)
 }
 
+// truncFrom deletes the last rune of m, which takes its line with it if it is the only rune on the last line
 func truncFrom(m *message, mi int) {
-	if !overflowed(m) {
-		if lastLineInViewport(m) {
+	ln, col := position(m.text, len(m.text)-1)
+	if ln == 0 || col != 0 {
+		if lineInViewport(m, ln) {
 			truncInLineInViewport(m)
 		} else {
 			truncInLineNotInViewport(m)
 		}
 	} else if isLast(m) {
-		if lastLineBarelyInViewport(m) {
+		if lineBarelyInViewport(m, ln) {
 			truncEndOfAllLinesBarelyInViewport(m)
-		} else if lastLineInViewport(m) {
+		} else if lineInViewport(m, ln) {
 			truncEndOfAllLinesInViewport(m)
 		} else {
 			truncEndOfAllLinesBelowViewport(m, mi)
 		}
 	} else {
-		if lastLineBarelyInViewport(m) {
+		if lineBarelyInViewport(m, ln) {
 			truncEndOfLineBarelyInViewport(m, mi)
-		} else if lastLineInViewport(m) {
+		} else if lineInViewport(m, ln) {
 			truncEndOfLineInViewport(m, mi)
-		} else if lastLineAboveViewport(m) {
+		} else if lineAboveViewport(m, ln) {
 			truncEndOfLineAboveViewport(m, mi)
 		} else {
 			truncEndOfLineBelowViewport(m, mi)
@@ -354,10 +360,12 @@ func truncFrom(m *message, mi int) {
 
 func truncInLineInViewport(m *message) {
 	l := len(m.text) - 1
-	cursorGoto(findAbsoluteLineNumberOf(m, l/ts.cpl)-ts.viewportTop, 14+l%ts.cpl)
+	ln, col := position(m.text, l)
+	w := runeWidth(m.text[l])
+	cursorGoto(findAbsoluteLineNumberOf(m, ln)-ts.viewportTop, 14+col)
 	resetStyles()
-	fmt.Print(" \b")
-	m.text = m.text[:len(m.text)-1]
+	fmt.Print(strings.Repeat(" ", w) + strings.Repeat("\b", w))
+	m.text = m.text[:l]
 }
 
 func truncInLineNotInViewport(m *message) {
@@ -383,7 +391,7 @@ func truncEndOfAllLinesBelowViewport(m *message, mi int) {
 }
 
 func truncEndOfLineAboveViewport(m *message, mi int) {
-	lli := m.absPos + len(m.text)/ts.cpl
+	lli := m.absPos + m.lCount() - 1
 	m.text = m.text[:len(m.text)-1]
 	lines = slices.Delete(lines, lli, lli+1)
 	ts.viewportTop -= 1
@@ -392,7 +400,7 @@ func truncEndOfLineAboveViewport(m *message, mi int) {
 }
 
 func truncEndOfLineBarelyInViewport(m *message, mi int) {
-	lli := m.absPos + len(m.text)/ts.cpl
+	lli := m.absPos + m.lCount() - 1
 	m.text = m.text[:len(m.text)-1]
 	lines = slices.Delete(lines, lli, lli+1)
 	ts.viewportTop -= 1
@@ -405,10 +413,10 @@ func truncEndOfLineBarelyInViewport(m *message, mi int) {
 }
 
 func truncEndOfLineInViewport(m *message, mi int) {
-	lli := m.absPos + len(m.text)/ts.cpl
+	lli := m.absPos + m.lCount() - 1
 	m.text = m.text[:len(m.text)-1]
 	lines = slices.Delete(lines, lli, lli+1)
-	if lastLineBarelyInViewport(m) {
+	if lli == ts.viewportTop {
 		cursorGoto(1, 1)
 		clearLine()
 		nl := lines[lli-1]
@@ -423,7 +431,7 @@ func truncEndOfLineInViewport(m *message, mi int) {
 }
 
 func truncEndOfLineBelowViewport(m *message, mi int) {
-	lli := m.absPos + len(m.text)/ts.cpl
+	lli := m.absPos + m.lCount() - 1
 	m.text = m.text[:len(m.text)-1]
 	lines = slices.Delete(lines, lli, lli+1)
 	updateAbsoluteLineNumbersAfter(mi, -1)
@@ -434,19 +442,18 @@ func messageNotInViewport(m *message) bool {
 }
 
 func idxJustInViewport(m *message, idx uint16) bool {
-	idxLine := int(idx) / ts.cpl
-	lc := len(m.text) / ts.cpl
-	return idxLine == lc && lastLineJustInViewport(msgs[len(msgs)-1])
+	idxLine, _ := position(m.text, int(idx))
+	return idxLine == m.endLine() && lastLineJustInViewport(msgs[len(msgs)-1])
 }
 
 func idxAffectingViewport(m *message, idx uint16) bool {
-	idxLine := int(idx) / ts.cpl
+	idxLine, _ := position(m.text, int(idx))
 	fliv := findFLInViewport(m)
 	return fliv > idxLine
 }
 
 func idxInViewport(m *message, idx uint16) bool {
-	idxLine := int(idx) / ts.cpl
+	idxLine, _ := position(m.text, int(idx))
 	return lnumInViewport(idxLine)
 }
 
@@ -456,9 +463,8 @@ func lnumInViewport(lnum int) bool {
 
 // idxInLastLine returns true if idx is in the last line
 func idxInLastLine(m *message, idx uint16) bool {
-	l := len(m.text)
-	lc := l / ts.cpl
-	return lc*ts.cpl <= int(idx)
+	idxLine, _ := position(m.text, int(idx))
+	return idxLine == m.endLine()
 }
 
 // isLast returns true if m is the last message
@@ -466,40 +472,40 @@ func isLast(m *message) bool {
 	return m == msgs[len(msgs)-1]
 }
 
-// lastLineInViewport returns true if the last line of m is in the viewport
-func lastLineInViewport(m *message) bool {
-	llpos := m.absPos + len(m.text)/ts.cpl
-	return lnumInViewport(llpos)
+// lineInViewport returns true if line ln of m is in the viewport
+func lineInViewport(m *message, ln int) bool {
+	return lnumInViewport(m.absPos + ln)
 }
 
-func lastLineBarelyInViewport(m *message) bool {
-	llpos := m.absPos + len(m.text)/ts.cpl - ts.viewportTop
-	return llpos == 0
+// lineBarelyInViewport returns true if line ln of m is the first line of the viewport
+func lineBarelyInViewport(m *message, ln int) bool {
+	return m.absPos+ln == ts.viewportTop
+}
+
+// lineJustInViewport returns true if line ln of m is the last line of the viewport
+func lineJustInViewport(m *message, ln int) bool {
+	return m.absPos+ln == ts.viewportBottom
+}
+
+func lineAboveViewport(m *message, ln int) bool {
+	return m.absPos+ln < ts.viewportTop
+}
+
+// lastLineInViewport returns true if the last line of m is in the viewport
+func lastLineInViewport(m *message) bool {
+	return lineInViewport(m, m.endLine())
 }
 
 // lastLineJustInViewport returns true if the last line of m is the last line of the viewport
 func lastLineJustInViewport(m *message) bool {
-	llpos := m.absPos + len(m.text)/ts.cpl
-	return llpos == ts.viewportBottom
+	return lineJustInViewport(m, m.endLine())
 }
 
 func lastLineAboveViewport(m *message) bool {
-	llpos := m.absPos + len(m.text)/ts.cpl
-	return llpos < ts.viewportTop
+	return lineAboveViewport(m, m.endLine())
 }
 
 // overflowing returns true if m is currently full
 func overflowing(m *message) bool {
-	l := len(m.text)
-	lc := l / ts.cpl
-	cill := l % ts.cpl
-	return cill == 0 && lc != 0
-}
-
-// overflowed returns true if m just overflowed
-func overflowed(m *message) bool {
-	l := len(m.text)
-	lc := l / ts.cpl
-	cill := l % ts.cpl
-	return cill == 1 && lc != 0
+	return len(m.text) > 0 && m.endLine() == m.lCount()
 }
@@ -0,0 +1,154 @@
+package client
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"slices"
+	"unicode/utf8"
+)
+
+var (
+	roster      = make(map[uint32]*user) // roster holds everyone in the room by the id that the server gave their connection
+	showRoster  bool
+	rosterStale bool // rosterStale is set when something has drawn over the sidebar since it was last drawn, such as scrolling the viewport
+)
+
+const (
+	rosterW = 16 // rosterW is how many columns the sidebar takes, including its border
+	minCpl  = 20 // minCpl is how many characters of a message must still fit on a line for the sidebar to be shown
+)
+
+// userJoined adds the user with id to the roster, or updates their name and color if they are already in it, keeping the key that they proved
+func userJoined(id uint32, color uint8, name string) {
+	fmtMu.Lock()
+	defer fmtMu.Unlock()
+
+	u := &user{c: color, name: name}
+	if old, ok := roster[id]; ok && old.key != nil {
+		u.key, u.badge = old.key, badgeFor(name, old.key)
+	}
+	roster[id] = u
+	renderRoster(true)
+}
+
+// userVerified marks the user with id as holding key
+func userVerified(id uint32, key ed25519.PublicKey) {
+	fmtMu.Lock()
+	defer fmtMu.Unlock()
+
+	u, ok := roster[id]
+	if !ok {
+		return
+	}
+	u.key, u.badge = key, badgeFor(u.name, key)
+	renderRoster(true)
+}
+
+// userLeft removes the user with id from the roster
+func userLeft(id uint32) {
+	fmtMu.Lock()
+	defer fmtMu.Unlock()
+
+	delete(roster, id)
+	renderRoster(true)
+}
+
+// rosterShown returns true if the sidebar is toggled on and the terminal is wide enough for it
+func rosterShown() bool {
+	return showRoster && ts.w-13-rosterW >= minCpl
+}
+
+// toggleRoster shows or hides the sidebar, and lays out every message again for the width that is left
+func toggleRoster() {
+	fmtMu.Lock()
+	defer fmtMu.Unlock()
+
+	showRoster = !showRoster
+	ts.cpl = ts.w - 13
+	if rosterShown() {
+		ts.cpl -= rosterW
+	}
+	relayout()
+}
+
+// refreshRoster draws the sidebar again if it is stale, which is checked after every event and keystroke, since those are what scroll the viewport
+func refreshRoster() {
+	fmtMu.Lock()
+	defer fmtMu.Unlock()
+	if rosterStale {
+		renderRoster(true)
+	}
+}
+
+// renderRoster draws the sidebar down the right of the viewport, with everyone in the room in the order that they connected.
+// It is called whenever the roster changes. Scrolling the viewport moves the sidebar along with it, and clearing a line clears it, so those mark it as stale for refreshRoster instead
+func renderRoster(alreadyLocked bool) {
+	if !alreadyLocked {
+		fmtMu.Lock()
+		defer fmtMu.Unlock()
+	}
+	if !rosterShown() || (is != chanNormal && is != chanInsert) {
+		return
+	}
+
+	ids := make([]uint32, 0, len(roster))
+	for id := range roster {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	fmt.Print("\0337")
+	for row := 1; row < ts.h; row++ {
+		cursorGoto(row, ts.w-rosterW+1)
+		resetStyles()
+		faint()
+		fmt.Print("│")
+		resetStyles()
+		fmt.Print("\033[K")
+		switch i := row - 2; {
+		case row == 1:
+			fmt.Printf(" %d here", len(ids))
+		case i < len(ids) && (row < ts.h-1 || i == len(ids)-1):
+			renderRosterName(roster[ids[i]])
+		case i < len(ids):
+			faint()
+			fmt.Printf(" +%d more", len(ids)-i)
+		}
+		resetStyles()
+	}
+	fmt.Print("\0338")
+	rosterStale = false
+}
+
+// renderRosterName prints the name of u in their color, cut to fit in the sidebar along with their badge. Users who haven't picked a name are shown as anonymous
+func renderRosterName(u *user) {
+	name := u.name
+	if name == "" {
+		name = "anonymous"
+		faint()
+	}
+	width := rosterW - 2 - utf8.RuneCountInString(u.badge)
+	if utf8.RuneCountInString(name) > width {
+		name = string([]rune(name)[:width])
+	}
+	setColor(u.c)
+	fmt.Print(" " + name)
+	if u.badge != "" {
+		resetStyles()
+		renderBadge(u.badge)
+	}
+}
+
+// relayout lays out the lines of every message again for the current width, moves the viewport to the last line, and redraws.
+// It must be called with fmtMu held
+func relayout() {
+	lines = make([]line, 0, len(lines))
+	for _, m := range msgs {
+		m.absPos = len(lines)
+		for n := 0; n < m.lCount(); n++ {
+			lines = append(lines, line{m, n})
+		}
+	}
+	ts.viewportTop = max(0, len(lines)-(ts.h-1))
+	ts.viewportBottom = ts.viewportTop + ts.h - 1
+	redraw()
+}
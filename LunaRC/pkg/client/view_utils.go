@@ -3,19 +3,30 @@ package client
 import (
 	"fmt"
 	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/width"
 )
 
 func moth() {
 	fmt.Println("  %%%%%%%\r\n %%%%%%%%%%  %%%            %   %           %%%%%%%%\r\n   %%%%%%%%%%%%%%%%%        %%%%     %%%%%%%%%%%%%%%%%%\r\n     %%%%%%%%%%%%%%%%%%%%%%% %% %%%%%%%%%%%%%%%%%%%%%%%%%%\r\n       %%%%%%%%%%%%%%%%%%%%% %% %%%%%%%%%%%%%%%%%%%%%%%\r\n            %%%%%%%%%%%%%%%% %% %%%%%%%%%%%%%%%%%%%%%\r\n         %%%%%%%%%%%%%%%%%%% %% %%%%%%%%%%%%%%\r\n       %%%%%%%%%%%%%%%%%%%%%    %%%%%%%%%%%%%%%%%%\r\n          %%%%%%%%%%%%         %%%%%%%%%%%%%%%%\r\n             %%%%%               %%%%%%%%%\r\n                                    %")
 }
 
+// faint returns true if m is drawn faint, since it is a replay or was abandoned
+func (m *message) faint() bool {
+	return m.replay || m.dropped
+}
+
 func appendToLine(l line, s string) {
 	if l.from.active {
 		setColor(l.from.user.c)
 		inverted()
 	}
+	if l.from.faint() {
+		faint()
+	}
 	fmt.Print(s)
-	if l.from.active {
+	if l.from.active || l.from.faint() {
 		resetStyles()
 	}
 }
@@ -27,14 +38,41 @@ func insertIntoLine(l line, s string) {
 
 func renderLine(l line) {
 	resetStyles()
-	nspaces := 12 - len(l.from.user.name)
-	fmt.Print(strings.Repeat(" ", nspaces))
+	name := l.from.user.name
+	badge := l.from.user.badge
+	indent := ""
+	if l.from.depth > 0 {
+		indent = strings.Repeat(" ", 2*(l.from.depth-1)) + "↳ "
+	}
+	width := 12 - utf8.RuneCountInString(indent) - utf8.RuneCountInString(badge)
+	name = truncateWidth(name, width)
+	if indent == "" {
+		fmt.Print(strings.Repeat(" ", 12-stringWidth(name)-utf8.RuneCountInString(badge)))
+	} else if l.num == 0 {
+		fmt.Print(indent)
+	} else {
+		fmt.Print(strings.Repeat(" ", 12))
+	}
 	if l.num == 0 {
 		setColor(l.from.user.c)
 		if l.from.active {
 			inverted()
 		}
-		fmt.Print(l.from.user.name)
+		if l.from.faint() {
+			faint()
+		}
+		if selected >= 0 && msgs[selected] == l.from {
+			underline()
+		}
+		fmt.Print(name)
+		if badge != "" {
+			resetStyles()
+			renderBadge(badge)
+		}
+		if indent != "" {
+			resetStyles()
+			fmt.Print(strings.Repeat(" ", width-stringWidth(name)))
+		}
 	}
 	resetStyles()
 	fmt.Print(" ")
@@ -42,6 +80,9 @@ func renderLine(l line) {
 		setColor(l.from.user.c)
 		inverted()
 	}
+	if l.from.faint() {
+		faint()
+	}
 	cursorBeginLine()
 	fmt.Print(lineContents(l))
 }
@@ -96,31 +137,105 @@ func scrollUpBelow(idx int) {
 	setupScrollRegion()
 }
 
+// insertCharacter makes room for a character at the cursor, which pushes the rest of the line, and the sidebar on it, to the right
 func insertCharacter() {
 	fmt.Print("\033[1@")
+	rosterStale = true
 }
 
 func setupScrollRegion() {
 	fmt.Printf("\033[1;%dr", ts.h-1)
 }
 
-func lineContents(l line) string {
-	ncpl := (ts.w - 13)
-	nlpm := len(l.from.text) / ncpl
+// runeWidth returns how many columns r takes up in a terminal, which is two for wide and fullwidth runes such as CJK and most emoji
+func runeWidth(r rune) int {
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
+
+// stringWidth returns how many columns s takes up in a terminal
+func stringWidth(s string) int {
+	w := 0
+	for _, r := range s {
+		w += runeWidth(r)
+	}
+	return w
+}
+
+// truncateWidth returns the longest prefix of s that fits in w columns
+func truncateWidth(s string, w int) string {
+	for i, r := range s {
+		w -= runeWidth(r)
+		if w < 0 {
+			return s[:i]
+		}
+	}
+	return s
+}
+
+// position returns the line and column that the rune at i of text is drawn at, or that a rune one column wide would be drawn at if i is the end of text.
+// Lines are broken by display width, so a wide rune that doesn't fit in what is left of a line starts the next one
+func position(text []rune, i int) (ln int, col int) {
+	for j := 0; j <= i; j++ {
+		w := 1
+		if j < len(text) {
+			w = runeWidth(text[j])
+		}
+		if col+w > ts.cpl && col > 0 {
+			ln++
+			col = 0
+		}
+		if j == i {
+			break
+		}
+		col += w
+	}
+	return ln, col
+}
 
-	if nlpm > l.num {
-		return l.from.text[l.num*ncpl : (l.num+1)*ncpl]
+// layout returns the index of the first rune of each line of m
+func (m *message) layout() []int {
+	starts := []int{0}
+	col := 0
+	for i, r := range m.text {
+		w := runeWidth(r)
+		if col+w > ts.cpl && col > 0 {
+			starts = append(starts, i)
+			col = 0
+		}
+		col += w
 	}
-	return l.from.text[l.num*ncpl:]
+	return starts
+}
+
+// endLine returns the line of m that the cursor is on after its last rune, which is the line after the last one if the last one is exactly full
+func (m *message) endLine() int {
+	ln, _ := position(m.text, len(m.text))
+	return ln
+}
+
+func lineContents(l line) string {
+	starts := l.from.layout()
+	if l.num >= len(starts) {
+		return ""
+	}
+	if l.num+1 < len(starts) {
+		return string(l.from.text[starts[l.num]:starts[l.num+1]])
+	}
+	return string(l.from.text[starts[l.num]:])
 }
 
 func lineFirst(l line) string {
-	ncpl := (ts.w - 13)
-	return string(l.from.text[l.num*ncpl])
+	return string(l.from.text[l.from.layout()[l.num]])
 }
 
+// clearLine clears the whole line that the cursor is on, including the part of the sidebar on it
 func clearLine() {
 	fmt.Printf("\033[2K")
+	rosterStale = true
 }
 
 func inverted() {
@@ -143,11 +258,13 @@ func cursorHome() {
 // scrollUp scrolls the region down, adding a new line at the top
 func scrollDown() {
 	fmt.Print("\033[1T")
+	rosterStale = true
 }
 
 // scrollUp scrolls the region up, adding a new line at the bottom
 func scrollUp() {
 	fmt.Print("\033[1S")
+	rosterStale = true
 }
 
 func cursorFullLeft() {
@@ -170,6 +287,10 @@ func faint() {
 	fmt.Print("\033[2m")
 }
 
+func underline() {
+	fmt.Print("\033[4m")
+}
+
 func cursorBar() {
 	fmt.Print("\033[5 q")
 }
@@ -0,0 +1,106 @@
+package events
+
+import "unicode/utf8"
+
+// Caps is a set of optional features of the LRC protocol. Each side of a connection sends the features it understands in its Hello,
+// and only the features that both of them understand are turned on.
+// The version of framing is negotiated by Version instead, since it has to change before any other feature can be used
+type Caps uint32
+
+const (
+	CapMultiInsert Caps = 1 << iota // CapMultiInsert lets an insert carry more than one character
+	CapHistory                      // CapHistory replays recently published messages on join
+	CapRooms                        // CapRooms lets a connection pick which room it talks in
+	CapRangeEdit                    // CapRangeEdit allows delete range and replace events
+	CapErrors                       // CapErrors lets the server answer rejected events with an error event
+	CapTopic                        // CapTopic lets the server send the topic of the room
+	CapThreads                      // CapThreads lets an init say which message it replies to
+	CapPresence                     // CapPresence lets the server say who is in the room, even if they aren't typing
+	CapIdentity                     // CapIdentity lets a client set its nick and color once, and leave them out of its inits
+	CapAbandon                      // CapAbandon lets the server end an active message without publishing it
+	CapSigned                       // CapSigned lets a client prove that it holds an ed25519 key, and lets the server say which users and messages are from a key
+)
+
+// Has returns true if c contains every feature in o
+func (c Caps) Has(o Caps) bool {
+	return c&o == o
+}
+
+// Shared returns the features that both a and b understand
+func Shared(a, b Caps) Caps {
+	return a & b
+}
+
+// Downgrade returns the events that have the same effect as e, using only the features in caps
+func Downgrade(e Event, caps Caps) []Event {
+	switch e := e.(type) {
+	case *Insert:
+		if caps.Has(CapMultiInsert) || utf8.RuneCountInString(e.Text) <= 1 {
+			break
+		}
+		evts := make([]Event, 0, len(e.Text))
+		at := e.At
+		for _, r := range e.Text {
+			evts = append(evts, &Insert{At: at, Text: string(r)})
+			at++
+		}
+		return evts
+	case *DeleteRange:
+		if caps.Has(CapRangeEdit) {
+			break
+		}
+		evts := make([]Event, 0, e.N)
+		for i := e.N; i > 0; i-- {
+			evts = append(evts, &Delete{At: e.At + i})
+		}
+		return evts
+	case *Replace:
+		if caps.Has(CapRangeEdit) {
+			break
+		}
+		evts := Downgrade(&DeleteRange{At: e.At, N: e.N}, caps)
+		if e.Text != "" {
+			evts = append(evts, Downgrade(&Insert{At: e.At, Text: e.Text}, caps)...)
+		}
+		return evts
+	case *Pub:
+		if caps.Has(CapHistory) || e.Time.IsZero() {
+			break
+		}
+		return []Event{&Pub{}}
+	case *Init:
+		if (caps.Has(CapThreads) || e.Parent == 0) && (caps.Has(CapSigned) || e.Key == nil) {
+			break
+		}
+		init := *e
+		if !caps.Has(CapThreads) {
+			init.Parent = 0
+		}
+		if !caps.Has(CapSigned) {
+			init.Key = nil
+		}
+		return []Event{&init}
+	case *SetTopic:
+		if !caps.Has(CapTopic) {
+			return nil
+		}
+	case *UserJoin, *UserLeave:
+		if !caps.Has(CapPresence) {
+			return nil
+		}
+	case *Identify:
+		if !caps.Has(CapIdentity) {
+			return nil
+		}
+	case *Challenge, *Prove, *Verified:
+		if !caps.Has(CapSigned) {
+			return nil
+		}
+	case *Abandon:
+		// a pub is the closest that older clients have, since it at least ends the message
+		if !caps.Has(CapAbandon) {
+			return []Event{&Pub{}}
+		}
+	}
+	return []Event{e}
+}
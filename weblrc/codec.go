@@ -0,0 +1,720 @@
+package events
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrEmptyEvent       = errors.New("empty event")
+	ErrUnknownEventType = errors.New("unknown event type")
+)
+
+// Event is a typed LRC event. It marshals to and from LRCTypedData, which is an LRCEvent without its length
+type Event interface {
+	Type() EventType
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// Ping is a request for a pong. When a server sends it, it may carry a welcome message.
+// A ping whose payload starts with a zero byte carries a Hello instead of a welcome message
+type Ping struct {
+	Welcome string
+	Hello   *Hello
+}
+
+// Hello negotiates the protocol. A client sends one before any other event, with the newest Version and all of the Caps it understands.
+// The server answers with the Version and Caps that both of them will use from then on.
+// Servers that predate Hello answer it with a pong, which means V1 and no Caps
+type Hello struct {
+	Version Version
+	Caps    Caps
+}
+
+// Pong answers a ping
+type Pong struct{}
+
+// Init initializes a message. Echo is set when the server sends the init back to the client that sent it,
+// and Replay is set when the server replays a message that was published before the client joined.
+// Parent is the id of the message that this one replies to, or 0 if it isn't a reply, and is only sent to clients with CapThreads.
+// Identified is set on an init that leaves out its color and name, so that the server fills them in from the identity of its sender, and is only sent to servers with CapIdentity.
+// Key is the key that the sender proved that they hold, if they did. Only the server sets it, and only sends it to clients with CapSigned
+type Init struct {
+	Echo       bool
+	Replay     bool
+	Identified bool
+	Color      uint8
+	Parent     uint32
+	Key        ed25519.PublicKey
+	Name       string
+}
+
+// the flags byte of an init
+const (
+	initEcho       byte = 1 << iota // initEcho is set on the init that the server echoes to its sender
+	initReplay                      // initReplay is set on the init of a message that the server replays from its history
+	initReply                       // initReply is set on the init of a reply, which has the id of its parent after its color
+	initIdentified                  // initIdentified is set on an init that leaves out its color and its name, so that the server fills them in from the identity of its sender
+	initSigned                      // initSigned is set on the init of a message from a key, which has the key before its name
+)
+
+// Pub publishes the active message. The server sets Time to when the message was published, and it is zero otherwise
+type Pub struct {
+	Time time.Time
+}
+
+// Insert inserts Text at position At of the active message. Text is UTF-8, and positions in a message count runes rather than bytes
+type Insert struct {
+	At   uint16
+	Text string
+}
+
+// Delete deletes the rune before position At of the active message
+type Delete struct {
+	At uint16
+}
+
+// DeleteRange deletes N runes starting at position At of the active message
+type DeleteRange struct {
+	At uint16
+	N  uint16
+}
+
+// Replace replaces N runes starting at position At of the active message with Text
+type Replace struct {
+	At   uint16
+	N    uint16
+	Text string
+}
+
+// ErrorCode says what was wrong with an event that the server rejected
+type ErrorCode uint8
+
+const (
+	ErrorInvalid    ErrorCode = iota // ErrorInvalid means the event made no sense, such as an empty insert
+	ErrorNoMessage                   // ErrorNoMessage means the event edits a message that is not active, such as one that was already published
+	ErrorOutOfRange                  // ErrorOutOfRange means the event edits a position that is past the end of the message
+	ErrorTooLong                     // ErrorTooLong means the event would make the message longer than positions can reach
+	ErrorEvicted                     // ErrorEvicted means the server is disconnecting the client, such as when it fell too far behind, and is not about any one event
+)
+
+// Error tells a client that the server rejected one of its events, and why. It is only sent to clients that have CapErrors
+type Error struct {
+	Code   ErrorCode
+	Reason string
+}
+
+// MuteUser mutes the author of the message with id ID for the client that sends it, so that the server stops sending it the author's events.
+// It is framed as [type][id uint32], and is never broadcast
+type MuteUser struct {
+	ID uint32
+}
+
+// UnmuteUser unmutes the author of the message with id ID for the client that sends it, and is framed like MuteUser
+type UnmuteUser struct {
+	ID uint32
+}
+
+// SetTopic sets the topic of the room when a client sends it, and tells a client what the topic is when the server sends it, such as when the client joins.
+// The server only sends it to clients with CapTopic
+type SetTopic struct {
+	Topic string
+}
+
+// UserJoin tells a client that the user whose id is the id of the server event is in the room, with the nick and color of their last init.
+// The server sends one for everyone in the room when a client joins, and again whenever someone joins or changes their nick or color.
+// It is framed as [type][color][name], and only sent to clients with CapPresence
+type UserJoin struct {
+	Color uint8
+	Name  string
+}
+
+// UserLeave tells a client that the user whose id is the id of the server event left the room
+type UserLeave struct{}
+
+// Identify sets the nick and color that a client's identified inits use, and that the server shows in the roster, until the client identifies again
+type Identify struct {
+	Color uint8
+	Name  string
+}
+
+// Abandon ends the active message with the id of the server event without publishing it, so that clients can grey it out or drop it
+type Abandon struct{}
+
+// Challenge asks a client with CapSigned to sign a nonce with its key, which the server sends straight after its hello.
+// Host is the host and port that the server's operator says it is reached at, which is signed along with the nonce. Clients only sign challenges for the host that they connected to,
+// so a server can't pass on another server's challenge to sign in there as its own clients.
+// It is framed as [type][nonce][host], where the nonce is NonceSize bytes
+type Challenge struct {
+	Nonce []byte
+	Host  string
+}
+
+// NonceSize is how long the nonce of a challenge is
+const NonceSize = 32
+
+// Signed returns what a client signs to answer c, which only a server on c.Host would ask for
+func (c *Challenge) Signed() []byte {
+	msg := append([]byte("lrc challenge\x00"), c.Host...)
+	msg = append(msg, 0)
+	return append(msg, c.Nonce...)
+}
+
+// Prove answers a challenge with the key that a client holds, and the signature of the challenge by that key.
+// It is framed as [type][key][signature]
+type Prove struct {
+	Key ed25519.PublicKey
+	Sig []byte
+}
+
+// Verified tells a client that the user whose id is the id of the server event proved that they hold Key, for as long as they are connected.
+// It is framed as [type][key], and only sent to clients with CapSigned
+type Verified struct {
+	Key ed25519.PublicKey
+}
+
+// Join moves a client into the room called Room, which the server answers with that room's welcome. It is only understood by servers with CapRooms
+type Join struct {
+	Room string
+}
+
+// String returns the name of t
+func (t EventType) String() string {
+	switch t {
+	case EventPing:
+		return "ping"
+	case EventPong:
+		return "pong"
+	case EventInit:
+		return "init"
+	case EventPub:
+		return "pub"
+	case EventInsert:
+		return "insert"
+	case EventDelete:
+		return "delete"
+	case EventMuteUser:
+		return "mute"
+	case EventUnmuteUser:
+		return "unmute"
+	case EventDeleteRange:
+		return "delete range"
+	case EventReplace:
+		return "replace"
+	case EventError:
+		return "error"
+	case EventJoin:
+		return "join"
+	case EventSetTopic:
+		return "set topic"
+	case EventUserJoin:
+		return "user join"
+	case EventUserLeave:
+		return "user leave"
+	case EventIdentify:
+		return "identify"
+	case EventAbandon:
+		return "abandon"
+	case EventChallenge:
+		return "challenge"
+	case EventProve:
+		return "prove"
+	case EventVerified:
+		return "verified"
+	}
+	return fmt.Sprintf("EventType(%d)", uint8(t))
+}
+
+// newEvent returns an empty Event of type t
+func newEvent(t EventType) (Event, error) {
+	switch t {
+	case EventPing:
+		return &Ping{}, nil
+	case EventPong:
+		return &Pong{}, nil
+	case EventInit:
+		return &Init{}, nil
+	case EventPub:
+		return &Pub{}, nil
+	case EventInsert:
+		return &Insert{}, nil
+	case EventDelete:
+		return &Delete{}, nil
+	case EventMuteUser:
+		return &MuteUser{}, nil
+	case EventUnmuteUser:
+		return &UnmuteUser{}, nil
+	case EventDeleteRange:
+		return &DeleteRange{}, nil
+	case EventReplace:
+		return &Replace{}, nil
+	case EventError:
+		return &Error{}, nil
+	case EventJoin:
+		return &Join{}, nil
+	case EventSetTopic:
+		return &SetTopic{}, nil
+	case EventUserJoin:
+		return &UserJoin{}, nil
+	case EventUserLeave:
+		return &UserLeave{}, nil
+	case EventIdentify:
+		return &Identify{}, nil
+	case EventAbandon:
+		return &Abandon{}, nil
+	case EventChallenge:
+		return &Challenge{}, nil
+	case EventProve:
+		return &Prove{}, nil
+	case EventVerified:
+		return &Verified{}, nil
+	}
+	return nil, fmt.Errorf("%w %d", ErrUnknownEventType, uint8(t))
+}
+
+// Decode decodes LRCTypedData into the Event corresponding to its EventType
+func Decode(td LRCTypedData) (Event, error) {
+	if len(td) == 0 {
+		return nil, ErrEmptyEvent
+	}
+	e, err := newEvent(EventType(td[0]))
+	if err != nil {
+		return nil, err
+	}
+	err = e.UnmarshalBinary(td)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// DecodeServerEvent decodes an LRCServerEvent with its length removed into the id it was sent from and its Event
+func DecodeServerEvent(se []byte) (uint32, Event, error) {
+	if len(se) < 5 {
+		return 0, nil, fmt.Errorf("server event is %d bytes, want at least 5", len(se))
+	}
+	e, err := Decode(se[4:])
+	if err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint32(se[0:4]), e, nil
+}
+
+// MarshalServerEvent returns the LRCServerEvent that sends e from id, framed in v
+func MarshalServerEvent(v Version, e Event, id uint32) (LRCServerEvent, error) {
+	td, err := e.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	se := make([]byte, 4, 4+len(td))
+	binary.BigEndian.PutUint32(se, id)
+	se = append(se, td...)
+	return AppendFrame(make([]byte, 0, len(se)+v.HeaderLen()), v, se)
+}
+
+// checkEvent returns an error if td is not of type t, or is shorter than min bytes
+func checkEvent(td []byte, t EventType, min int) error {
+	if len(td) == 0 {
+		return ErrEmptyEvent
+	}
+	if EventType(td[0]) != t {
+		return fmt.Errorf("cannot unmarshal %s event into %s", EventType(td[0]), t)
+	}
+	if len(td) < min {
+		return fmt.Errorf("%s event is %d bytes, want at least %d", t, len(td), min)
+	}
+	return nil
+}
+
+func (*Ping) Type() EventType { return EventPing }
+
+func (e *Ping) MarshalBinary() ([]byte, error) {
+	if e.Hello != nil {
+		td := []byte{byte(EventPing), 0, byte(e.Hello.Version)}
+		return binary.BigEndian.AppendUint32(td, uint32(e.Hello.Caps)), nil
+	}
+	return append([]byte{byte(EventPing)}, e.Welcome...), nil
+}
+
+func (e *Ping) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventPing, 1); err != nil {
+		return err
+	}
+	e.Welcome, e.Hello = "", nil
+	if len(td) == 1 || td[1] != 0 {
+		e.Welcome = string(td[1:])
+		return nil
+	}
+	if len(td) < 3 {
+		return fmt.Errorf("hello is %d bytes, want at least 3", len(td))
+	}
+	e.Hello = &Hello{Version: Version(td[2])}
+	if len(td) >= 7 {
+		e.Hello.Caps = Caps(binary.BigEndian.Uint32(td[3:7]))
+	}
+	return nil
+}
+
+func (*Pong) Type() EventType { return EventPong }
+
+func (*Pong) MarshalBinary() ([]byte, error) {
+	return []byte{byte(EventPong)}, nil
+}
+
+func (*Pong) UnmarshalBinary(td []byte) error {
+	return checkEvent(td, EventPong, 1)
+}
+
+func (*Init) Type() EventType { return EventInit }
+
+func (e *Init) MarshalBinary() ([]byte, error) {
+	var flags byte
+	if e.Echo {
+		flags |= initEcho
+	}
+	if e.Replay {
+		flags |= initReplay
+	}
+	if e.Parent != 0 {
+		flags |= initReply
+	}
+	if e.Identified {
+		flags |= initIdentified
+	}
+	if e.Key != nil {
+		if len(e.Key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key is %d bytes, want %d", len(e.Key), ed25519.PublicKeySize)
+		}
+		flags |= initSigned
+	}
+	td := []byte{byte(EventInit), flags}
+	if !e.Identified {
+		td = append(td, e.Color)
+	}
+	if e.Parent != 0 {
+		td = binary.BigEndian.AppendUint32(td, e.Parent)
+	}
+	td = append(td, e.Key...)
+	if e.Identified {
+		return td, nil
+	}
+	return append(td, e.Name...), nil
+}
+
+func (e *Init) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventInit, 2); err != nil {
+		return err
+	}
+	e.Echo = td[1]&initEcho != 0
+	e.Replay = td[1]&initReplay != 0
+	e.Identified = td[1]&initIdentified != 0
+	e.Color, e.Parent, e.Key, e.Name = 0, 0, nil, ""
+	rest := td[2:]
+	if !e.Identified {
+		if len(rest) < 1 {
+			return fmt.Errorf("init is %d bytes, want at least 3", len(td))
+		}
+		e.Color = rest[0]
+		rest = rest[1:]
+	}
+	if td[1]&initReply != 0 {
+		if len(rest) < 4 {
+			return fmt.Errorf("reply init is %d bytes, want at least %d", len(td), len(td)-len(rest)+4)
+		}
+		e.Parent = binary.BigEndian.Uint32(rest)
+		rest = rest[4:]
+	}
+	if td[1]&initSigned != 0 {
+		if len(rest) < ed25519.PublicKeySize {
+			return fmt.Errorf("signed init is %d bytes, want at least %d", len(td), len(td)-len(rest)+ed25519.PublicKeySize)
+		}
+		e.Key = ed25519.PublicKey(bytes.Clone(rest[:ed25519.PublicKeySize]))
+		rest = rest[ed25519.PublicKeySize:]
+	}
+	if !e.Identified {
+		e.Name = string(rest)
+	}
+	return nil
+}
+
+func (*Pub) Type() EventType { return EventPub }
+
+func (e *Pub) MarshalBinary() ([]byte, error) {
+	td := []byte{byte(EventPub)}
+	if e.Time.IsZero() {
+		return td, nil
+	}
+	return binary.BigEndian.AppendUint64(td, uint64(e.Time.UnixMilli())), nil
+}
+
+func (e *Pub) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventPub, 1); err != nil {
+		return err
+	}
+	e.Time = time.Time{}
+	if len(td) >= 9 {
+		e.Time = time.UnixMilli(int64(binary.BigEndian.Uint64(td[1:9])))
+	}
+	return nil
+}
+
+func (*Insert) Type() EventType { return EventInsert }
+
+func (e *Insert) MarshalBinary() ([]byte, error) {
+	td := []byte{byte(EventInsert), 0, 0}
+	binary.BigEndian.PutUint16(td[1:], e.At)
+	return append(td, e.Text...), nil
+}
+
+func (e *Insert) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventInsert, 3); err != nil {
+		return err
+	}
+	e.At = binary.BigEndian.Uint16(td[1:3])
+	e.Text = string(td[3:])
+	return nil
+}
+
+func (*Delete) Type() EventType { return EventDelete }
+
+func (e *Delete) MarshalBinary() ([]byte, error) {
+	td := []byte{byte(EventDelete), 0, 0}
+	binary.BigEndian.PutUint16(td[1:], e.At)
+	return td, nil
+}
+
+func (e *Delete) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventDelete, 3); err != nil {
+		return err
+	}
+	e.At = binary.BigEndian.Uint16(td[1:3])
+	return nil
+}
+
+func (*DeleteRange) Type() EventType { return EventDeleteRange }
+
+func (e *DeleteRange) MarshalBinary() ([]byte, error) {
+	td := []byte{byte(EventDeleteRange), 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(td[1:], e.At)
+	binary.BigEndian.PutUint16(td[3:], e.N)
+	return td, nil
+}
+
+func (e *DeleteRange) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventDeleteRange, 5); err != nil {
+		return err
+	}
+	e.At = binary.BigEndian.Uint16(td[1:3])
+	e.N = binary.BigEndian.Uint16(td[3:5])
+	return nil
+}
+
+func (*Replace) Type() EventType { return EventReplace }
+
+func (e *Replace) MarshalBinary() ([]byte, error) {
+	td := []byte{byte(EventReplace), 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(td[1:], e.At)
+	binary.BigEndian.PutUint16(td[3:], e.N)
+	return append(td, e.Text...), nil
+}
+
+func (e *Replace) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventReplace, 5); err != nil {
+		return err
+	}
+	e.At = binary.BigEndian.Uint16(td[1:3])
+	e.N = binary.BigEndian.Uint16(td[3:5])
+	e.Text = string(td[5:])
+	return nil
+}
+
+func (*Error) Type() EventType { return EventError }
+
+func (e *Error) MarshalBinary() ([]byte, error) {
+	return append([]byte{byte(EventError), byte(e.Code)}, e.Reason...), nil
+}
+
+func (e *Error) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventError, 2); err != nil {
+		return err
+	}
+	e.Code = ErrorCode(td[1])
+	e.Reason = string(td[2:])
+	return nil
+}
+
+// Error returns the reason that the server gave, so that an Error can be used as an error
+func (e *Error) Error() string {
+	return e.Reason
+}
+
+func (*MuteUser) Type() EventType { return EventMuteUser }
+
+func (e *MuteUser) MarshalBinary() ([]byte, error) {
+	td := []byte{byte(EventMuteUser), 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(td[1:], e.ID)
+	return td, nil
+}
+
+func (e *MuteUser) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventMuteUser, 5); err != nil {
+		return err
+	}
+	e.ID = binary.BigEndian.Uint32(td[1:5])
+	return nil
+}
+
+func (*UnmuteUser) Type() EventType { return EventUnmuteUser }
+
+func (e *UnmuteUser) MarshalBinary() ([]byte, error) {
+	td := []byte{byte(EventUnmuteUser), 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(td[1:], e.ID)
+	return td, nil
+}
+
+func (e *UnmuteUser) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventUnmuteUser, 5); err != nil {
+		return err
+	}
+	e.ID = binary.BigEndian.Uint32(td[1:5])
+	return nil
+}
+
+func (*Join) Type() EventType { return EventJoin }
+
+func (e *Join) MarshalBinary() ([]byte, error) {
+	return append([]byte{byte(EventJoin)}, e.Room...), nil
+}
+
+func (e *Join) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventJoin, 1); err != nil {
+		return err
+	}
+	e.Room = string(td[1:])
+	return nil
+}
+
+func (*SetTopic) Type() EventType { return EventSetTopic }
+
+func (e *SetTopic) MarshalBinary() ([]byte, error) {
+	return append([]byte{byte(EventSetTopic)}, e.Topic...), nil
+}
+
+func (e *SetTopic) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventSetTopic, 1); err != nil {
+		return err
+	}
+	e.Topic = string(td[1:])
+	return nil
+}
+
+func (*UserJoin) Type() EventType { return EventUserJoin }
+
+func (e *UserJoin) MarshalBinary() ([]byte, error) {
+	return append([]byte{byte(EventUserJoin), e.Color}, e.Name...), nil
+}
+
+func (e *UserJoin) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventUserJoin, 2); err != nil {
+		return err
+	}
+	e.Color = td[1]
+	e.Name = string(td[2:])
+	return nil
+}
+
+func (*UserLeave) Type() EventType { return EventUserLeave }
+
+func (*UserLeave) MarshalBinary() ([]byte, error) {
+	return []byte{byte(EventUserLeave)}, nil
+}
+
+func (*UserLeave) UnmarshalBinary(td []byte) error {
+	return checkEvent(td, EventUserLeave, 1)
+}
+
+func (*Identify) Type() EventType { return EventIdentify }
+
+func (e *Identify) MarshalBinary() ([]byte, error) {
+	return append([]byte{byte(EventIdentify), e.Color}, e.Name...), nil
+}
+
+func (e *Identify) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventIdentify, 2); err != nil {
+		return err
+	}
+	e.Color = td[1]
+	e.Name = string(td[2:])
+	return nil
+}
+
+func (*Abandon) Type() EventType { return EventAbandon }
+
+func (*Abandon) MarshalBinary() ([]byte, error) {
+	return []byte{byte(EventAbandon)}, nil
+}
+
+func (*Abandon) UnmarshalBinary(td []byte) error {
+	return checkEvent(td, EventAbandon, 1)
+}
+
+func (*Challenge) Type() EventType { return EventChallenge }
+
+func (e *Challenge) MarshalBinary() ([]byte, error) {
+	if len(e.Nonce) != NonceSize {
+		return nil, fmt.Errorf("nonce is %d bytes, want %d", len(e.Nonce), NonceSize)
+	}
+	td := append([]byte{byte(EventChallenge)}, e.Nonce...)
+	return append(td, e.Host...), nil
+}
+
+func (e *Challenge) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventChallenge, 1+NonceSize); err != nil {
+		return err
+	}
+	e.Nonce = bytes.Clone(td[1 : 1+NonceSize])
+	e.Host = string(td[1+NonceSize:])
+	return nil
+}
+
+func (*Prove) Type() EventType { return EventProve }
+
+func (e *Prove) MarshalBinary() ([]byte, error) {
+	if len(e.Key) != ed25519.PublicKeySize || len(e.Sig) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("key and signature are %d and %d bytes, want %d and %d", len(e.Key), len(e.Sig), ed25519.PublicKeySize, ed25519.SignatureSize)
+	}
+	td := append([]byte{byte(EventProve)}, e.Key...)
+	return append(td, e.Sig...), nil
+}
+
+func (e *Prove) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventProve, 1+ed25519.PublicKeySize+ed25519.SignatureSize); err != nil {
+		return err
+	}
+	e.Key = ed25519.PublicKey(bytes.Clone(td[1 : 1+ed25519.PublicKeySize]))
+	e.Sig = bytes.Clone(td[1+ed25519.PublicKeySize : 1+ed25519.PublicKeySize+ed25519.SignatureSize])
+	return nil
+}
+
+func (*Verified) Type() EventType { return EventVerified }
+
+func (e *Verified) MarshalBinary() ([]byte, error) {
+	if len(e.Key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("key is %d bytes, want %d", len(e.Key), ed25519.PublicKeySize)
+	}
+	return append([]byte{byte(EventVerified)}, e.Key...), nil
+}
+
+func (e *Verified) UnmarshalBinary(td []byte) error {
+	if err := checkEvent(td, EventVerified, 1+ed25519.PublicKeySize); err != nil {
+		return err
+	}
+	e.Key = ed25519.PublicKey(bytes.Clone(td[1 : 1+ed25519.PublicKeySize]))
+	return nil
+}
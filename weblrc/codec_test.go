@@ -0,0 +1,262 @@
+package events
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = ed25519.PublicKey(bytes.Repeat([]byte{7}, ed25519.PublicKeySize))
+
+// roundTrips holds an event of every type, along with the flag combinations of inits and the hello inside a ping
+var roundTrips = []Event{
+	&Ping{},
+	&Ping{Welcome: "Welcome To lobby"},
+	&Ping{Hello: &Hello{Version: V2, Caps: CapMultiInsert | CapSigned}},
+	&Ping{Hello: &Hello{Version: V1}},
+	&Pong{},
+	&Init{Color: 13, Name: "wanderer"},
+	&Init{Color: 13},
+	&Init{Echo: true, Color: 1, Name: "a"},
+	&Init{Replay: true, Color: 2, Name: "b"},
+	&Init{Color: 3, Parent: 99, Name: "c"},
+	&Init{Identified: true},
+	&Init{Identified: true, Parent: 7},
+	&Init{Color: 4, Key: testKey, Name: "d"},
+	&Init{Echo: true, Replay: true, Identified: true, Parent: 1 << 31, Key: testKey},
+	&Init{Echo: true, Replay: true, Color: 255, Parent: 5, Key: testKey, Name: "é✓"},
+	&Pub{},
+	&Pub{Time: time.UnixMilli(1700000000123)},
+	&Insert{At: 3, Text: "héllo 🌙"},
+	&Insert{At: 65535},
+	&Delete{At: 1},
+	&DeleteRange{At: 2, N: 40},
+	&Replace{At: 1, N: 2, Text: "xyz"},
+	&Replace{At: 1, N: 2},
+	&Error{Code: ErrorTooLong, Reason: "too long"},
+	&Error{Code: ErrorEvicted},
+	&MuteUser{ID: 42},
+	&UnmuteUser{ID: 1 << 30},
+	&Join{Room: "dev"},
+	&SetTopic{Topic: "lrc"},
+	&SetTopic{},
+	&UserJoin{Color: 9, Name: "luna"},
+	&UserJoin{},
+	&UserLeave{},
+	&Identify{Color: 8, Name: "rachel"},
+	&Abandon{},
+	&Challenge{Nonce: bytes.Repeat([]byte{1}, NonceSize), Host: "moth11.net:927"},
+	&Challenge{Nonce: bytes.Repeat([]byte{2}, NonceSize)},
+	&Prove{Key: testKey, Sig: bytes.Repeat([]byte{3}, ed25519.SignatureSize)},
+	&Verified{Key: testKey},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, e := range roundTrips {
+		td, err := e.MarshalBinary()
+		if err != nil {
+			t.Errorf("marshaling %#v: %s", e, err)
+			continue
+		}
+		if EventType(td[0]) != e.Type() {
+			t.Errorf("%#v marshaled as %s", e, EventType(td[0]))
+		}
+		got, err := Decode(td)
+		if err != nil {
+			t.Errorf("decoding %#v from %x: %s", e, td, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, e) {
+			t.Errorf("decoded %#v from %x, want %#v", got, td, e)
+		}
+	}
+}
+
+// TestRoundTripCoversEveryType checks that roundTrips has an event of every type that Decode knows
+func TestRoundTripCoversEveryType(t *testing.T) {
+	seen := make(map[EventType]bool)
+	for _, e := range roundTrips {
+		seen[e.Type()] = true
+	}
+	for et := EventType(0); et < 255; et++ {
+		if _, err := newEvent(et); err != nil {
+			continue
+		}
+		if !seen[et] {
+			t.Errorf("no round trip for %s", et)
+		}
+		if strings.HasPrefix(et.String(), "EventType(") {
+			t.Errorf("%d has no name", et)
+		}
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	for _, td := range [][]byte{
+		{},
+		{200},
+		{byte(EventPing), 0},
+		{byte(EventInit)},
+		{byte(EventInit), 0},
+		{byte(EventInit), initReply, 1, 0, 0},
+		{byte(EventInit), initIdentified | initReply, 0, 0, 1},
+		{byte(EventInit), initSigned, 1, 7, 7},
+		{byte(EventInit), initIdentified | initSigned},
+		{byte(EventInsert), 0},
+		{byte(EventDelete), 0},
+		{byte(EventDeleteRange), 0, 0, 0},
+		{byte(EventReplace), 0, 0, 0},
+		{byte(EventError)},
+		{byte(EventMuteUser), 0, 0, 0},
+		{byte(EventUnmuteUser)},
+		{byte(EventUserJoin)},
+		{byte(EventIdentify)},
+		{byte(EventChallenge), 1, 2, 3},
+		append([]byte{byte(EventProve)}, testKey...),
+		{byte(EventVerified), 1},
+	} {
+		if e, err := Decode(td); err == nil {
+			t.Errorf("decoded %#v from malformed %x", e, td)
+		}
+	}
+	if _, err := Decode(nil); !errors.Is(err, ErrEmptyEvent) {
+		t.Errorf("decoding nothing gave %v, want %v", err, ErrEmptyEvent)
+	}
+	if _, err := Decode([]byte{200}); !errors.Is(err, ErrUnknownEventType) {
+		t.Errorf("decoding type 200 gave %v, want %v", err, ErrUnknownEventType)
+	}
+	if err := (&Insert{}).UnmarshalBinary([]byte{byte(EventDelete), 0, 1}); err == nil {
+		t.Error("unmarshaled a delete into an insert")
+	}
+}
+
+func TestMarshalRejectsBadKeys(t *testing.T) {
+	for _, e := range []Event{
+		&Init{Key: testKey[:5]},
+		&Challenge{Nonce: []byte{1}},
+		&Prove{Key: testKey, Sig: []byte{1}},
+		&Verified{Key: testKey[1:]},
+	} {
+		if td, err := e.MarshalBinary(); err == nil {
+			t.Errorf("marshaled %#v as %x", e, td)
+		}
+	}
+}
+
+func TestServerEventRoundTrip(t *testing.T) {
+	for _, v := range []Version{V1, V2} {
+		se, err := MarshalServerEvent(v, &Insert{At: 1, Text: "hi"}, 77)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := Unframe(v, se)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, e, err := DecodeServerEvent(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id != 77 || !reflect.DeepEqual(e, &Insert{At: 1, Text: "hi"}) {
+			t.Errorf("v%d: got %d %#v", v, id, e)
+		}
+	}
+	if _, _, err := DecodeServerEvent([]byte{0, 0, 0, 1}); err == nil {
+		t.Error("decoded a server event without an event")
+	}
+}
+
+// TestParseInitEvent checks that the legacy init parsers agree with Decode on every init in roundTrips
+func TestParseInitEvent(t *testing.T) {
+	for _, e := range roundTrips {
+		init, ok := e.(*Init)
+		if !ok {
+			continue
+		}
+		se, err := MarshalServerEvent(V1, init, 42)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, color, name, echo := ParseInitEvent(se[1:])
+		if id != 42 || color != init.Color || name != init.Name || echo != init.Echo || ParseInitParent(se[1:]) != init.Parent {
+			t.Errorf("parsed %#v as %d %d %q %t %d", init, id, color, name, echo, ParseInitParent(se[1:]))
+		}
+		if key := ParseInitKey(se[1:]); !bytes.Equal(key, init.Key) {
+			t.Errorf("parsed the key of %#v as %x", init, key)
+		}
+	}
+}
+
+// TestFit checks that inserts and replaces too big for a frame are split into ones that each marshal into a frame, and that have the same effect
+func TestFit(t *testing.T) {
+	long := strings.Repeat("a✓🌙", 100)
+	for _, v := range []Version{V1, V2} {
+		for _, e := range []Event{
+			&Insert{At: 2, Text: long},
+			&Insert{At: 2, Text: strings.Repeat(long, 100)},
+			&Replace{At: 2, N: 3, Text: long},
+			&Insert{At: 2, Text: "hi"},
+			&Replace{At: 2, N: 3, Text: "hi"},
+			&Pub{},
+		} {
+			want := []rune("0123456789")
+			apply(&want, e)
+			got := []rune("0123456789")
+			for _, fe := range Fit(e, v) {
+				if _, err := MarshalServerEvent(v, fe, 1<<31); err != nil {
+					t.Errorf("v%d: %T split from %T doesn't fit: %s", v, fe, e, err)
+				}
+				apply(&got, fe)
+			}
+			if string(got) != string(want) {
+				t.Errorf("v%d: %T split into events with another effect", v, e)
+			}
+		}
+	}
+}
+
+// apply applies an insert or replace to text
+func apply(text *[]rune, e Event) {
+	switch e := e.(type) {
+	case *Insert:
+		*text = slices.Insert(*text, int(e.At), []rune(e.Text)...)
+	case *Replace:
+		*text = slices.Replace(*text, int(e.At), int(e.At+e.N), []rune(e.Text)...)
+	}
+}
+
+// FuzzDecode checks that Decode never panics, and that whatever it decodes marshals to a frame that decodes to the same event
+func FuzzDecode(f *testing.F) {
+	for _, e := range roundTrips {
+		td, err := e.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(td)
+	}
+	f.Add([]byte{byte(EventPing), 0, 2})
+	f.Add([]byte{byte(EventInit), 0xff, 1, 0, 0, 0, 1})
+	f.Fuzz(func(t *testing.T, td []byte) {
+		e, err := Decode(td)
+		if err != nil {
+			return
+		}
+		b, err := e.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%#v decoded from %x doesn't marshal: %s", e, td, err)
+		}
+		e2, err := Decode(b)
+		if err != nil {
+			t.Fatalf("%#v marshaled as %x, which doesn't decode: %s", e, b, err)
+		}
+		b2, err := e2.MarshalBinary()
+		if err != nil || !bytes.Equal(b, b2) {
+			t.Fatalf("%x decoded to %#v, which marshaled as %x, then %x", td, e, b, b2)
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package events
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Version is a version of the LRC protocol, which determines how events are framed
+type Version uint8
+
+const (
+	V1 Version = 1 // V1 prefixes each event with a single byte holding the length of the frame, so frames are at most 255 bytes
+	V2 Version = 2 // V2 prefixes each event with two big endian bytes holding the length of the frame, so frames are at most 65535 bytes
+
+	MaxVersion = V2 // MaxVersion is the newest version that this package speaks
+)
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+// Negotiate returns the newest version spoken by both a and b
+func Negotiate(a, b Version) Version {
+	v := min(a, b, MaxVersion)
+	if v < V1 {
+		return V1
+	}
+	return v
+}
+
+// HeaderLen returns how many bytes the length of a frame takes up in v
+func (v Version) HeaderLen() int {
+	if v >= V2 {
+		return 2
+	}
+	return 1
+}
+
+// MaxFrameLen returns the length of the longest frame, including its header, in v
+func (v Version) MaxFrameLen() int {
+	if v >= V2 {
+		return 0xffff
+	}
+	return 0xff
+}
+
+// AppendFrame appends data to dst, prepended by its length as framed in v
+func AppendFrame(dst []byte, v Version, data []byte) ([]byte, error) {
+	l := len(data) + v.HeaderLen()
+	if l > v.MaxFrameLen() {
+		return dst, fmt.Errorf("%w: %d bytes is longer than the %d allowed by version %d", ErrFrameTooLarge, l, v.MaxFrameLen(), v)
+	}
+	if v >= V2 {
+		dst = binary.BigEndian.AppendUint16(dst, uint16(l))
+	} else {
+		dst = append(dst, byte(l))
+	}
+	return append(dst, data...), nil
+}
+
+// FrameLen returns the length of the frame, including its header, given the header of the frame in v
+func FrameLen(v Version, header []byte) (int, error) {
+	if len(header) < v.HeaderLen() {
+		return 0, fmt.Errorf("frame header is %d bytes, want %d", len(header), v.HeaderLen())
+	}
+	var l int
+	if v >= V2 {
+		l = int(binary.BigEndian.Uint16(header))
+	} else {
+		l = int(header[0])
+	}
+	if l <= v.HeaderLen() {
+		return 0, fmt.Errorf("event length %d", l)
+	}
+	return l, nil
+}
+
+// Unframe returns the data of a single frame in v, without its header
+func Unframe(v Version, frame []byte) ([]byte, error) {
+	l, err := FrameLen(v, frame)
+	if err != nil {
+		return nil, err
+	}
+	if l != len(frame) {
+		return nil, fmt.Errorf("frame claims %d bytes, but has %d", l, len(frame))
+	}
+	return frame[v.HeaderLen():], nil
+}
+
+// Frame marshals e and frames it in v
+func Frame(v Version, e Event) (LRCEvent, error) {
+	td, err := e.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	return AppendFrame(make([]byte, 0, len(td)+v.HeaderLen()), v, td)
+}
+
+// Fit returns the events that have the same effect as e, each small enough to be sent by the server in a single frame of v.
+// Inserts and replaces are the only events that can outgrow a frame, so their text is split into inserts at rune boundaries
+func Fit(e Event, v Version) []Event {
+	// a server event holds the id of its message, then the type and position of the insert, before its text
+	room := v.MaxFrameLen() - v.HeaderLen() - 4 - 3
+	switch e := e.(type) {
+	case *Insert:
+		if len(e.Text) <= room {
+			break
+		}
+		evts := make([]Event, 0, len(e.Text)/room+1)
+		at, text := e.At, e.Text
+		for text != "" {
+			n := len(text)
+			if n > room {
+				n = room
+				for !utf8.RuneStart(text[n]) {
+					n--
+				}
+			}
+			evts = append(evts, &Insert{At: at, Text: text[:n]})
+			at += uint16(utf8.RuneCountInString(text[:n]))
+			text = text[n:]
+		}
+		return evts
+	case *Replace:
+		// a replace also holds how many runes it replaces
+		if len(e.Text) <= room-2 {
+			break
+		}
+		return append([]Event{&Replace{At: e.At, N: e.N}}, Fit(&Insert{At: e.At, Text: e.Text}, v)...)
+	}
+	return []Event{e}
+}
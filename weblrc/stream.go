@@ -0,0 +1,138 @@
+package events
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// Decoder reads framed LRC events from a stream, such as a tcp connection, without needing a goroutine to degunk it.
+// It reads every frame into the same buffer, so it only allocates when a frame is longer than any before it
+type Decoder struct {
+	r       *bufio.Reader
+	version Version
+	buf     []byte
+}
+
+// NewDecoder returns a Decoder that reads V1 frames from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:       bufio.NewReader(r),
+		version: V1,
+		buf:     make([]byte, V1.MaxFrameLen()),
+	}
+}
+
+// SetVersion changes the version that the following frames are read in, such as after a hello
+func (d *Decoder) SetVersion(v Version) {
+	d.version = v
+}
+
+// NextFrame returns the data of the next frame, without its header.
+// The data is only valid until the next call to d, so it must be copied to be kept
+func (d *Decoder) NextFrame() ([]byte, error) {
+	hl := d.version.HeaderLen()
+	header, err := d.r.Peek(hl)
+	if err != nil {
+		if err == io.EOF && len(header) > 0 {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	l, err := FrameLen(d.version, header)
+	if err != nil {
+		return nil, err
+	}
+	if l > cap(d.buf) {
+		d.buf = make([]byte, l)
+	}
+	frame := d.buf[:l]
+	_, err = io.ReadFull(d.r, frame)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame[hl:], nil
+}
+
+// Next reads and decodes the next frame as LRCTypedData, which is what a client sends
+func (d *Decoder) Next() (Event, error) {
+	td, err := d.NextFrame()
+	if err != nil {
+		return nil, err
+	}
+	return Decode(td)
+}
+
+// NextServerEvent reads and decodes the next frame as an LRCServerEvent, which is what a server sends
+func (d *Decoder) NextServerEvent() (uint32, Event, error) {
+	se, err := d.NextFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+	return DecodeServerEvent(se)
+}
+
+// Encoder writes framed LRC events to a stream through a bufio.Writer, so nothing is sent until it is flushed
+type Encoder struct {
+	w       *bufio.Writer
+	version Version
+	buf     []byte
+}
+
+// NewEncoder returns an Encoder that writes V1 frames to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:       bufio.NewWriter(w),
+		version: V1,
+		buf:     make([]byte, 0, V1.MaxFrameLen()),
+	}
+}
+
+// SetVersion changes the version that the following frames are written in, such as after a hello
+func (e *Encoder) SetVersion(v Version) {
+	e.version = v
+}
+
+// WriteFrame frames data, which is either LRCTypedData or an LRCServerEvent without its length, and buffers it
+func (e *Encoder) WriteFrame(data []byte) error {
+	var err error
+	e.buf, err = AppendFrame(e.buf[:0], e.version, data)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(e.buf)
+	return err
+}
+
+// WriteRaw buffers a frame that has already been framed in the version that e writes
+func (e *Encoder) WriteRaw(frame []byte) error {
+	_, err := e.w.Write(frame)
+	return err
+}
+
+// Encode marshals evt as LRCTypedData and buffers its frame
+func (e *Encoder) Encode(evt Event) error {
+	td, err := evt.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return e.WriteFrame(td)
+}
+
+// EncodeServerEvent marshals evt as an LRCServerEvent from id and buffers its frame
+func (e *Encoder) EncodeServerEvent(id uint32, evt Event) error {
+	td, err := evt.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	se := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(td)), id)
+	return e.WriteFrame(append(se, td...))
+}
+
+// Flush writes everything that has been buffered to the stream
+func (e *Encoder) Flush() error {
+	return e.w.Flush()
+}
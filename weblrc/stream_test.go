@@ -0,0 +1,140 @@
+package events
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// the stream that the benchmarks read, which is chunked the way a tcp connection would chunk it
+const (
+	benchEvents = 1000
+	benchChunk  = 512
+)
+
+// genStream returns n V1 frames of the events that typing messages produces
+func genStream(n int) []byte {
+	var buf []byte
+	typed := []Event{&Init{Color: 13, Name: "wanderer"}}
+	for i := range 12 {
+		typed = append(typed, &Insert{At: uint16(i), Text: "a"})
+	}
+	typed = append(typed, &Delete{At: 12}, &Pub{})
+	for i := range n {
+		frame, _ := Frame(V1, typed[i%len(typed)])
+		buf = append(buf, frame...)
+	}
+	return buf
+}
+
+func chunk(b []byte, size int) [][]byte {
+	var chunks [][]byte
+	for len(b) > size {
+		chunks = append(chunks, b[:size])
+		b = b[size:]
+	}
+	return append(chunks, b)
+}
+
+// chunkReader reads chunks one at a time, like reads from a tcp connection
+type chunkReader struct {
+	chunks [][]byte
+	r      bytes.Reader
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for cr.r.Len() == 0 {
+		if len(cr.chunks) == 0 {
+			return 0, io.EOF
+		}
+		cr.r.Reset(cr.chunks[0])
+		cr.chunks = cr.chunks[1:]
+	}
+	return cr.r.Read(p)
+}
+
+// degunk pushes chunks through a Degunker and returns how many events came out
+func degunk(chunks [][]byte) int {
+	in := make(chan []byte)
+	out := make(chan LRCEvent)
+	quit := make(chan struct{})
+	go Degunker(V1, 16, in, out, quit)
+	go func() {
+		for _, c := range chunks {
+			in <- c
+		}
+		close(in)
+	}()
+	n := 0
+	for {
+		select {
+		case <-out:
+			n++
+		case <-quit:
+			return n
+		}
+	}
+}
+
+// TestDecoderReadsChunkedStream checks that the Decoder and the Degunker both find every frame of a stream whose frames are split across reads
+func TestDecoderReadsChunkedStream(t *testing.T) {
+	chunks := chunk(genStream(benchEvents), 7)
+	d := NewDecoder(&chunkReader{chunks: chunks})
+	n := 0
+	for {
+		_, err := d.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("after %d events: %s", n, err)
+		}
+		n++
+	}
+	if n != benchEvents {
+		t.Errorf("decoded %d events, want %d", n, benchEvents)
+	}
+	if n := degunk(chunks); n != benchEvents {
+		t.Errorf("degunked %d events, want %d", n, benchEvents)
+	}
+}
+
+func BenchmarkDegunker(b *testing.B) {
+	data := genStream(benchEvents)
+	chunks := chunk(data, benchChunk)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for range b.N {
+		degunk(chunks)
+	}
+}
+
+func BenchmarkDecoderNextFrame(b *testing.B) {
+	data := genStream(benchEvents)
+	chunks := chunk(data, benchChunk)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for range b.N {
+		d := NewDecoder(&chunkReader{chunks: chunks})
+		for {
+			if _, err := d.NextFrame(); err != nil {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkDecoderNext(b *testing.B) {
+	data := genStream(benchEvents)
+	chunks := chunk(data, benchChunk)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for range b.N {
+		d := NewDecoder(&chunkReader{chunks: chunks})
+		for {
+			if _, err := d.Next(); err != nil {
+				break
+			}
+		}
+	}
+}
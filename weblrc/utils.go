@@ -1,6 +1,7 @@
 package events
 
 import (
+	"crypto/ed25519"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -20,14 +21,26 @@ var ClientPong = []byte{2, 1}
 var ClientPing = []byte{2, 0}
 
 const (
-	EventPing       EventType = iota // EventPing is a request for a pong, and if it comes from a server, it can also contain a welcome message
-	EventPong                        // EventPong determines the latency of the connection, and if the connection has closed
-	EventInit                        // EventInit initializes a message
-	EventPub                         // EventPub publishes a message
-	EventInsert                      // EventInsert inserts a character at a specified position in a message
-	EventDelete                      // EventDelete deletes a character at a specified position in a message
-	EventMuteUser                    // EventMuteUser mutes a user based on a message id. only works going forward
-	EventUnmuteUser                  // EventUnmuteUser unmutes a user based on a post id. only works going forward
+	EventPing        EventType = iota // EventPing is a request for a pong, and if it comes from a server, it can also contain a welcome message
+	EventPong                         // EventPong determines the latency of the connection, and if the connection has closed
+	EventInit                         // EventInit initializes a message
+	EventPub                          // EventPub publishes a message
+	EventInsert                       // EventInsert inserts UTF-8 text at a specified position in a message, where positions count runes
+	EventDelete                       // EventDelete deletes a rune at a specified position in a message
+	EventMuteUser                     // EventMuteUser mutes a user based on a message id. only works going forward
+	EventUnmuteUser                   // EventUnmuteUser unmutes a user based on a message id. only works going forward
+	EventDeleteRange                  // EventDeleteRange deletes a run of runes starting at a specified position in a message
+	EventReplace                      // EventReplace replaces a run of runes starting at a specified position in a message with UTF-8 text
+	EventError                        // EventError tells a client that the server rejected one of its events, and why
+	EventJoin                         // EventJoin moves a client into a room, leaving the one it was in
+	EventSetTopic                     // EventSetTopic sets the topic of a room, and tells the clients in it what the topic is
+	EventUserJoin                     // EventUserJoin tells a client that a user is in the room, or that their nick or color changed
+	EventUserLeave                    // EventUserLeave tells a client that a user left the room
+	EventIdentify                     // EventIdentify sets the nick and color of a connection, which its inits can then leave out
+	EventAbandon                      // EventAbandon ends an active message without publishing it, such as when its author disconnects
+	EventChallenge                    // EventChallenge asks a client to prove that it holds its key by signing a nonce
+	EventProve                        // EventProve answers a challenge with a key and the signature of the challenge by that key
+	EventVerified                     // EventVerified tells a client that a user proved that they hold a key
 )
 
 // IsPing returns true if e is a ping event
@@ -64,7 +77,7 @@ func GenServerEvent(data LRCTypedData, id uint32) (LRCServerEvent, LRCServerEven
 	if IsInit(data) {
 		ee = make([]byte, len(se))
 		copy(ee, se)
-		ee[6] = 1
+		ee[6] |= 1
 	}
 	return se, ee
 }
@@ -76,6 +89,15 @@ func GenInitEvent(color uint8, name string) LRCEvent {
 	return e
 }
 
+// GenReplyInitEvent returns an init of a message that replies to the message with id parent, which should only be sent to servers with CapThreads
+func GenReplyInitEvent(color uint8, name string, parent uint32) LRCEvent {
+	e := []byte{byte(EventInit), 4, color}
+	e = binary.BigEndian.AppendUint32(e, parent)
+	e = append(e, []byte(name)...)
+	PrependLength(&e)
+	return e
+}
+
 func GenPubEvent() LRCEvent {
 	e := []byte{byte(EventPub)}
 	PrependLength(&e)
@@ -101,7 +123,23 @@ func GenDeleteEvent(at uint16) LRCEvent {
 	return e
 }
 
-// PrependLength prepends the length of the data
+// GenMuteUserEvent returns an event that mutes the author of the message with id, so that the server stops sending us their events
+func GenMuteUserEvent(id uint32) LRCEvent {
+	e := []byte{byte(EventMuteUser)}
+	e = binary.BigEndian.AppendUint32(e, id)
+	PrependLength(&e)
+	return e
+}
+
+// GenUnmuteUserEvent returns an event that unmutes the author of the message with id
+func GenUnmuteUserEvent(id uint32) LRCEvent {
+	e := []byte{byte(EventUnmuteUser)}
+	e = binary.BigEndian.AppendUint32(e, id)
+	PrependLength(&e)
+	return e
+}
+
+// PrependLength prepends the length of the data, as framed in V1. Data that is too long for V1 should be framed with AppendFrame instead
 func PrependLength(data *[]byte) {
 	l := len(*data) + 1
 	n := make([]byte, 1, l)
@@ -113,8 +151,51 @@ func ParseEventType(e LRCEvent) EventType {
 	return EventType(e[4])
 }
 
+// ParseInitEvent returns the id, color and name of an init, and whether it is an echo. An identified init has neither a color nor a name, so they are left empty.
+// The key of a signed init is skipped, and can be read with ParseInitKey
 func ParseInitEvent(e LRCEvent) (uint32, uint8, string, bool) {
-	return binary.BigEndian.Uint32(e[0:4]), e[6], string(e[7:]), e[5]==1
+	var color uint8
+	rest := e[6:]
+	if e[5]&initIdentified == 0 {
+		color, rest = rest[0], rest[1:]
+	}
+	if e[5]&initReply != 0 {
+		rest = rest[4:]
+	}
+	if e[5]&initSigned != 0 {
+		rest = rest[ed25519.PublicKeySize:]
+	}
+	var name string
+	if e[5]&initIdentified == 0 {
+		name = string(rest)
+	}
+	return binary.BigEndian.Uint32(e[0:4]), color, name, e[5]&initEcho != 0
+}
+
+// ParseInitParent returns the id of the message that an init replies to, or 0 if it isn't a reply
+func ParseInitParent(e LRCEvent) uint32 {
+	if e[5]&initReply == 0 {
+		return 0
+	}
+	if e[5]&initIdentified != 0 {
+		return binary.BigEndian.Uint32(e[6:10])
+	}
+	return binary.BigEndian.Uint32(e[7:11])
+}
+
+// ParseInitKey returns the key that the author of an init proved that they hold, or nil if it isn't signed
+func ParseInitKey(e LRCEvent) ed25519.PublicKey {
+	if e[5]&initSigned == 0 {
+		return nil
+	}
+	at := 6
+	if e[5]&initIdentified == 0 {
+		at++
+	}
+	if e[5]&initReply != 0 {
+		at += 4
+	}
+	return ed25519.PublicKey(e[at : at+ed25519.PublicKeySize])
 }
 
 func ParsePubEvent(e LRCEvent) uint32 {
@@ -122,28 +203,35 @@ func ParsePubEvent(e LRCEvent) uint32 {
 }
 
 func ParseInsertEvent(e LRCEvent) (uint32, uint16, string) {
-	return binary.BigEndian.Uint32(e[0:4]), binary.BigEndian.Uint16(e[5:7]), string(e[7])
+	return binary.BigEndian.Uint32(e[0:4]), binary.BigEndian.Uint16(e[5:7]), string(e[7:])
 }
 
 func ParseDeleteEvent(e LRCEvent) (uint32, uint16) {
 	return binary.BigEndian.Uint32(e[0:4]), binary.BigEndian.Uint16(e[5:7])
 }
 
+// ParseMuteUserEvent returns the message id of a mute or unmute event that a client sent, which is LRCTypedData rather than a server event, since servers don't send them
+func ParseMuteUserEvent(td LRCTypedData) uint32 {
+	return binary.BigEndian.Uint32(td[1:5])
+}
+
 type ringBuffer struct {
-	buffer [][]byte
-	head   int
-	tail   int
-	data   int
-	cap    int
+	buffer  [][]byte
+	head    int
+	tail    int
+	data    int
+	cap     int
+	version Version
 }
 
-func newRingBuffer(capacity int) *ringBuffer {
+func newRingBuffer(capacity int, v Version) *ringBuffer {
 	if capacity < 1 {
 		panic("capacity must be at least 1")
 	}
 	return &ringBuffer{
-		buffer: make([][]byte, capacity),
-		cap:    capacity,
+		buffer:  make([][]byte, capacity),
+		cap:     capacity,
+		version: v,
 	}
 }
 
@@ -161,15 +249,16 @@ func (rb *ringBuffer) enqueue(e []byte) error {
 	return nil
 }
 
-func (rb *ringBuffer) dequeue(target byte) ([]byte, error) {
-	if rb.data < int(target) {
+// dequeue removes an event target bytes long from the buffer, and returns it without its length
+func (rb *ringBuffer) dequeue(target int) ([]byte, error) {
+	if rb.data < target {
 		return nil, fmt.Errorf("cannot dequeue %d bytes from %d bytes", target, rb.data)
 	}
 	result := make([]byte, 0, target)
 
-	for len(result) < int(target) {
+	for len(result) < target {
 		front := rb.buffer[rb.head]
-		needed := int(target) - len(result)
+		needed := target - len(result)
 
 		if len(front) <= needed {
 			result = append(result, front...)
@@ -180,30 +269,40 @@ func (rb *ringBuffer) dequeue(target byte) ([]byte, error) {
 			rb.buffer[rb.head] = front[needed:]
 		}
 	}
-	rb.data -= int(target)
-	result = result[1:]
+	rb.data -= target
+	result = result[rb.version.HeaderLen():]
 	return result, nil
 }
 
-func (rb *ringBuffer) getTarget() (byte, error) {
+// peek returns the first n bytes in the buffer without removing them, which may span several chunks
+func (rb *ringBuffer) peek(n int) []byte {
+	result := make([]byte, 0, n)
+	for i := rb.head; i != rb.tail && len(result) < n; i = (i + 1) % rb.cap {
+		front := rb.buffer[i]
+		result = append(result, front[:min(len(front), n-len(result))]...)
+	}
+	return result
+}
+
+// getTarget returns the length of the next event in the buffer, or 0 if its length has not been fully recieved yet
+func (rb *ringBuffer) getTarget() (int, error) {
 	if rb.length() == 0 {
 		panic("should not get target on empty buffer")
 	}
-	target := rb.buffer[rb.head][0]
-	if target == 0 {
-		return 0, errors.New("event length 0")
+	if rb.data < rb.version.HeaderLen() {
+		return 0, nil
 	}
-	return target, nil
+	return FrameLen(rb.version, rb.peek(rb.version.HeaderLen()))
 }
 
-// Degunker recieves a channel in of bytes that we read from the tcp connection, which may correspond to less than one, just one, or more than one lrc events.
+// Degunker recieves a channel in of bytes that we read from the tcp connection, which may correspond to less than one, just one, or more than one lrc events framed in v.
 // It stores up to capacity of these events, and whenever it stores enough data corresponding to an LRCEvent, it sends it out on the out channel.
 // If something goes wrong, (it runs out of capacity, it recieves an event length 0,) it closes the quit channel, and returns an error.
 // It will return with no error if the in channel closes. It will panic if the out channel closes.
-func Degunker(capacity int, in chan []byte, out chan LRCEvent, quit chan struct{}) error {
-	var target byte
+func Degunker(v Version, capacity int, in chan []byte, out chan LRCEvent, quit chan struct{}) error {
+	var target int
 	var err error
-	rb := newRingBuffer(capacity)
+	rb := newRingBuffer(capacity, v)
 	for {
 		b, ok := <-in
 		if !ok {
@@ -217,7 +316,7 @@ func Degunker(capacity int, in chan []byte, out chan LRCEvent, quit chan struct{
 			return err
 		}
 
-		for int(target) <= rb.data {
+		for target <= rb.data {
 			if target == 0 {
 				if rb.length() == 0 {
 					break
@@ -227,7 +326,7 @@ func Degunker(capacity int, in chan []byte, out chan LRCEvent, quit chan struct{
 					close(quit)
 					return err
 				}
-				if int(target) > rb.data {
+				if target == 0 || target > rb.data {
 					break
 				}
 			}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+)
+
+// Identity is who a client was authenticated as. It is attached to the client before it is upgraded, and never changes after that,
+// so anything can read it
+type Identity struct {
+	Name string `json:"name"` // Name is the nick that the client has to use, or empty if it can use any
+}
+
+// Authenticator decides who is connecting from the request that they connect with, before it is upgraded to a websocket.
+// It returns a nil identity for clients that are let in anonymously, and an error for clients that aren't let in at all
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+var errNoToken = errors.New("no token")
+
+// tokenAuth is the Authenticator that checks tokens against the -tokens file, and lets everyone in anonymously if there isn't one.
+// Clients send their token as a bearer token in the Authorization header, in the lrc_token cookie or in the token query parameter,
+// since browsers can't set headers on websockets
+type tokenAuth struct{}
+
+func (tokenAuth) Authenticate(r *http.Request) (*Identity, error) {
+	c := cfg()
+	if c.Tokens == "" {
+		return nil, nil
+	}
+	token := tokenOf(r)
+	if token == "" {
+		return nil, errNoToken
+	}
+	id, ok := c.tokens[token]
+	if !ok {
+		return nil, errors.New("unknown token")
+	}
+	return id, nil
+}
+
+// tokenOf returns the token that r was sent with, or empty if it doesn't have one
+func tokenOf(r *http.Request) string {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(bearer)
+	}
+	if cookie, err := r.Cookie("lrc_token"); err == nil {
+		return cookie.Value
+	}
+	return r.URL.Query().Get("token")
+}
+
+// loadTokens reads the tokens file, which is a JSON object of identities by token, such as {"s3cret": {"name": "rachel"}}
+func loadTokens(file string) (map[string]*Identity, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var tokens map[string]*Identity
+	err = json.Unmarshal(b, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	for token, id := range tokens {
+		if id == nil {
+			tokens[token] = &Identity{}
+		}
+	}
+	return tokens, nil
+}
+
+// checkOrigin lets browsers connect from the allowed origins, which may have a * in place of a host or a subdomain, such as https://*.moth11.net.
+// If none are allowed, browsers can only connect from pages on the same host, and a lone * lets them connect from anywhere.
+// Clients that aren't browsers don't send an origin, and can always connect
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	origins := cfg().Origins
+	if len(origins) == 0 {
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+	for _, allowed := range origins {
+		if ok, _ := path.Match(strings.ToLower(allowed), strings.ToLower(origin)); ok || allowed == "*" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestNick(t *testing.T) {
+	rachel, nameless := &Identity{Name: "rachel"}, &Identity{}
+	useConfig(t, func(c *config) {
+		c.Tokens = "tokens.json"
+		c.tokens = map[string]*Identity{"s3cret": rachel, "other": {Name: "luna"}, "anon": nameless}
+	})
+	for _, tc := range []struct {
+		id   *Identity
+		name string
+		want string
+	}{
+		{rachel, "anything", "rachel"},
+		{rachel, "", "rachel"},
+		{nameless, "luna", ""},
+		{nameless, "Rachel", ""},
+		{nameless, "wanderer", "wanderer"},
+		{nil, "LUNA", ""},
+		{nil, "wanderer", "wanderer"},
+		{nil, "", ""},
+	} {
+		client := &Client{identity: tc.id}
+		if got := client.nick(tc.name); got != tc.want {
+			t.Errorf("%+v asking for %q got %q, want %q", tc.id, tc.name, got, tc.want)
+		}
+	}
+}
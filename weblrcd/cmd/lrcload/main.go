@@ -0,0 +1,140 @@
+// lrcload connects many clients to one room of a running weblrcd, and has all of them type at the same time for a while.
+// It prints how many keystrokes went in and how many events came back out, which is the throughput of the server's fan out
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+	"time"
+	events "weblrc"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	addr     = flag.String("addr", "localhost:927", "address of the weblrcd to load")
+	nClients = flag.Int("clients", 1000, "number of clients typing at the same time")
+	room     = flag.String("room", "load", "room that every client types in")
+	rate     = flag.Float64("rate", 5, "keystrokes per second that each client types")
+	msgLen   = flag.Int("len", 40, "keystrokes in each message, after which it is published")
+	duration = flag.Duration("duration", 10*time.Second, "how long the clients type for")
+)
+
+var sent, received, receivedBytes, evicted atomic.Int64
+
+func main() {
+	flag.Parse()
+	conns := make([]*websocket.Conn, 0, *nClients)
+	for i := range *nClients {
+		conn, err := connect(i)
+		if err != nil {
+			fmt.Println("connected", len(conns), "clients before failing:", err)
+			return
+		}
+		conns = append(conns, conn)
+	}
+	// let the server catch everyone up before counting, so that only typing is measured
+	time.Sleep(time.Second)
+	received.Store(0)
+	receivedBytes.Store(0)
+
+	start := time.Now()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func() { defer wg.Done(); typeUntil(conn, stop) }()
+	}
+	time.Sleep(*duration)
+	close(stop)
+	wg.Wait()
+	elapsed := time.Since(start)
+	// events that are still on their way are not counted, since the server is behind by however many there are
+	in, out, outBytes := sent.Load(), received.Load(), receivedBytes.Load()
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	secs := elapsed.Seconds()
+	fmt.Printf("%d clients typed %d keystrokes in %s, %.0f per second\n", len(conns), in, elapsed.Round(time.Millisecond), float64(in)/secs)
+	fmt.Printf("received %d events, %.0f per second, %.1f MB/s\n", out, float64(out)/secs, float64(outBytes)/secs/1e6)
+	fmt.Printf("delivered %.1f%% of a full fan out, %d clients were evicted\n", 100*float64(out)/float64(in*int64(len(conns))), evicted.Load())
+}
+
+// connect connects a client that says hello, identifies, and counts everything that the server sends it from then on
+func connect(i int) (*websocket.Conn, error) {
+	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/ws/%s", *addr, *room), nil)
+	if err != nil {
+		return nil, err
+	}
+	// single keystroke inserts are the worst case, so the clients don't ask for CapMultiInsert
+	hello, _ := events.Frame(events.V1, &events.Ping{Hello: &events.Hello{Version: events.MaxVersion, Caps: events.CapErrors | events.CapIdentity}})
+	conn.WriteMessage(websocket.BinaryMessage, hello)
+	go func() {
+		v := events.V1
+		for {
+			_, m, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received.Add(1)
+			receivedBytes.Add(int64(len(m)))
+			td, err := events.Unframe(v, m)
+			if err != nil {
+				continue
+			}
+			_, e, err := events.DecodeServerEvent(td)
+			if err != nil {
+				continue
+			}
+			switch e := e.(type) {
+			case *events.Ping:
+				if e.Hello != nil {
+					v = e.Hello.Version
+				}
+			case *events.Error:
+				if e.Code == events.ErrorEvicted {
+					evicted.Add(1)
+				}
+			}
+		}
+	}()
+	time.Sleep(time.Millisecond)
+	identify, _ := events.Frame(events.MaxVersion, &events.Identify{Color: uint8(i), Name: fmt.Sprintf("load%d", i)})
+	return conn, conn.WriteMessage(websocket.BinaryMessage, identify)
+}
+
+// typeUntil types messages on conn at -rate until stop is closed, starting at a random point so that the clients don't all type in step
+func typeUntil(conn *websocket.Conn, stop chan struct{}) {
+	tick := time.Duration(float64(time.Second) / *rate)
+	time.Sleep(rand.N(tick))
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	at := 0
+	for {
+		var e events.Event
+		switch {
+		case at == 0:
+			e = &events.Init{Identified: true}
+		case at > *msgLen:
+			e = &events.Pub{}
+			at = -1
+		default:
+			e = &events.Insert{At: uint16(at - 1), Text: "x"}
+		}
+		at++
+		f, _ := events.Frame(events.MaxVersion, e)
+		if conn.WriteMessage(websocket.BinaryMessage, f) != nil {
+			return
+		}
+		sent.Add(1)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
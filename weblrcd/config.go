@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// config is everything about weblrcd that can be changed without changing its code. Every field but Welcomes can be set by a flag,
+// and all of them can be set by the JSON config file given to -config, whose keys are the names of the flags. Flags that are set win over the file.
+// The file is read again on SIGHUP, but the listen addresses, TLS, the log directory and the default room only change on restart
+type config struct {
+	Listen      string            `json:"listen"`
+	Host        string            `json:"host"`
+	TCP         string            `json:"tcp"`
+	TLSCert     string            `json:"tls-cert"`
+	TLSKey      string            `json:"tls-key"`
+	Origins     list              `json:"origins"`
+	Welcome     string            `json:"welcome"`
+	Welcomes    map[string]string `json:"welcomes"` // Welcomes holds the welcome messages of rooms other than the default room, by room name
+	LogDir      string            `json:"log"`
+	LogLevel    string            `json:"log-level"`
+	DefaultRoom string            `json:"default-room"`
+	Rooms       list              `json:"rooms"`
+	Abandon     bool              `json:"abandon"`
+	Backlog     int               `json:"backlog"`
+	MaxBacklog  int               `json:"maxbacklog"`
+	Grace       duration          `json:"grace"`
+	Tokens      string            `json:"tokens"`
+
+	tokens map[string]*Identity // tokens is what was loaded from Tokens
+}
+
+// bind registers a flag for every field of c on fs, and sets each field to its default
+func bind(fs *flag.FlagSet, c *config) {
+	fs.StringVar(&c.Listen, "listen", ":927", "address to listen for websocket clients on")
+	fs.StringVar(&c.Host, "host", "", "host and port that websocket clients connect to, such as moth11.net:927, which they sign their challenges for when they prove their keys. keys can't be proved if this is empty")
+	fs.StringVar(&c.TCP, "tcp", "", "address to listen for raw tcp clients on, such as :928. raw tcp is off if this is empty")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "certificate to serve websockets and raw tcp over tls with, along with -tls-key, which is loaded again whenever it changes. tls is off if this is empty")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "private key of -tls-cert")
+	fs.Var(&c.Origins, "origins", "comma separated origins that browsers may connect from, such as https://moth11.net or https://*.moth11.net, or * for any origin. browsers may only connect from the same host if this is empty")
+	fs.StringVar(&c.Welcome, "welcome", "Welcome To The Beginning Of The Rest Of Your Life", "welcome message of the default room")
+	fs.StringVar(&c.LogDir, "log", "", "directory to keep the log of published messages in, so that history survives restarts. history is only kept in memory if this is empty")
+	fs.StringVar(&c.LogLevel, "log-level", "debug", "how much to log, which is debug or info")
+	fs.StringVar(&c.DefaultRoom, "default-room", "lobby", "room that clients are in until they pick one, such as clients that connect to /ws")
+	fs.Var(&c.Rooms, "rooms", "comma separated rooms that clients may be in. any valid room name may be used if this is empty")
+	fs.BoolVar(&c.Abandon, "abandon", false, "abandon the active messages of clients that disconnect or change rooms, instead of publishing the ones that have text")
+	fs.IntVar(&c.Backlog, "backlog", 64, "how many events can be waiting for a client before it counts as slow, after which its inserts are merged while they wait")
+	fs.IntVar(&c.MaxBacklog, "maxbacklog", 4096, "how many events can be waiting for a client before it is evicted")
+	c.Grace = duration(10 * time.Second)
+	fs.Var(&c.Grace, "grace", "how long a client can stay slow before it is evicted")
+	fs.StringVar(&c.Tokens, "tokens", "", `JSON file of the identities that websocket clients are let in as, by token, such as {"s3cret": {"name": "rachel"}}. clients with a name have to use it as their nick, and nobody else can use it. clients are let in anonymously if this is empty`)
+}
+
+var (
+	configPath = flag.String("config", "", "JSON file to read the config from, which is read again on SIGHUP. flags that are set win over it")
+	flagged    config // flagged is where flags are parsed into, which only matters for the flags that were set
+	current    atomic.Pointer[config]
+)
+
+func init() {
+	bind(flag.CommandLine, &flagged)
+}
+
+// cfg returns the config that is in use. It is never changed, only replaced as a whole, so it can be read from any goroutine
+func cfg() *config {
+	return current.Load()
+}
+
+// loadConfig returns the defaults, overridden by the config file if there is one, and then by any flags that were set
+func loadConfig() (*config, error) {
+	c := &config{}
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	bind(fs, c)
+	if *configPath != "" {
+		f, err := os.ReadFile(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		dec := json.NewDecoder(strings.NewReader(string(f)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(c); err != nil {
+			return nil, fmt.Errorf("%s: %w", *configPath, err)
+		}
+	}
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			err = errors.Join(err, fs.Set(f.Name, f.Value.String()))
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if c.Tokens != "" {
+		c.tokens, err = loadTokens(c.Tokens)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, c.validate()
+}
+
+// validate rejects configs that weblrcd can't run with
+func (c *config) validate() error {
+	if c.LogLevel != "debug" && c.LogLevel != "info" {
+		return fmt.Errorf("log level %q is not debug or info", c.LogLevel)
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return errors.New("tls needs both a certificate and a key")
+	}
+	if !validRoom(c.DefaultRoom) {
+		return fmt.Errorf("default room %q is not a valid room name", c.DefaultRoom)
+	}
+	if len(c.Rooms) > 0 && !slices.Contains(c.Rooms, c.DefaultRoom) {
+		return fmt.Errorf("default room %q is not one of the rooms", c.DefaultRoom)
+	}
+	for _, name := range c.Rooms {
+		if !validRoom(name) {
+			return fmt.Errorf("room %q is not a valid room name", name)
+		}
+	}
+	if c.Tokens != "" && c.TCP != "" {
+		return errors.New("raw tcp clients can't send tokens, so they can't be let in when there are tokens")
+	}
+	if c.Host != "" {
+		if _, _, err := net.SplitHostPort(c.Host); err != nil {
+			return fmt.Errorf("host %q is not a host and port, such as moth11.net:927", c.Host)
+		}
+	}
+	if c.Backlog < 1 || c.MaxBacklog < c.Backlog {
+		return fmt.Errorf("backlog of %d and max backlog of %d don't leave room for a slow client", c.Backlog, c.MaxBacklog)
+	}
+	return nil
+}
+
+// allows returns true if clients may be in the room called name
+func (c *config) allows(name string) bool {
+	return validRoom(name) && (len(c.Rooms) == 0 || slices.Contains(c.Rooms, name))
+}
+
+// reserves returns true if name belongs to someone in the tokens file, ignoring case so that nobody can pass for them by changing it
+func (c *config) reserves(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, id := range c.tokens {
+		if strings.EqualFold(id.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// welcomeFor returns the welcome message of the room called name
+func (c *config) welcomeFor(name string) string {
+	if name == c.DefaultRoom {
+		return c.Welcome
+	}
+	if w, ok := c.Welcomes[name]; ok {
+		return w
+	}
+	return fmt.Sprintf("Welcome To %s", name)
+}
+
+// reloadOnHangup reads the config again whenever weblrcd gets a SIGHUP. A config that doesn't load is logged and ignored,
+// and the settings that only change on restart are kept as they are
+func reloadOnHangup() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		c, err := loadConfig()
+		if err != nil {
+			log.Println("kept the old config, since the new one failed to load:", err)
+			continue
+		}
+		old := cfg()
+		if c.Listen != old.Listen || c.TCP != old.TCP || c.TLSCert != old.TLSCert || c.TLSKey != old.TLSKey || c.LogDir != old.LogDir || c.DefaultRoom != old.DefaultRoom {
+			log.Println("listen addresses, tls, the log directory and the default room only change on restart")
+		}
+		c.Listen, c.TCP, c.TLSCert, c.TLSKey, c.LogDir, c.DefaultRoom = old.Listen, old.TCP, old.TLSCert, old.TLSKey, old.LogDir, old.DefaultRoom
+		if err := c.validate(); err != nil {
+			log.Println("kept the old config, since it doesn't work with the settings that only change on restart:", err)
+			continue
+		}
+		current.Store(c)
+		log.Println("reloaded the config")
+	}
+}
+
+// list is a flag that holds comma separated values, and is a plain array in the config file
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// duration is a flag that holds a time.Duration, and is a string such as "10s" in the config file
+type duration time.Duration
+
+func (d *duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	*d = duration(v)
+	return err
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
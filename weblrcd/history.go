@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"time"
+	events "weblrc"
+	"weblrcd/msglog"
+)
+
+// publishedMsg is a message that has been published, as it is kept in the history
+type publishedMsg struct {
+	id        uint32
+	parent    uint32
+	color     uint8
+	name      string
+	key       ed25519.PublicKey // key is the key that the author proved that they hold, which isn't kept in the log, so messages restored from it don't have one
+	text      string
+	published time.Time
+	author    *Client // author is nil for messages restored from the log, since their authors disconnected when the server stopped
+}
+
+var historyLen = 100 // historyLen is how many published messages the history of each room holds
+
+// openLog opens the message log of r in dir, and restores the history and the last id from it, so that ids are not reused after a restart
+func (r *room) openLog(dir string) error {
+	var err error
+	r.msgLog, err = msglog.Open(dir, 0)
+	if err != nil {
+		return err
+	}
+	recs, err := r.msgLog.Last(historyLen)
+	if err != nil {
+		return fmt.Errorf("reading history from %s: %w", dir, err)
+	}
+	for _, rec := range recs {
+		r.keep(publishedMsg{rec.ID, rec.Parent, rec.Color, rec.Name, nil, rec.Text, rec.Time, nil})
+	}
+	r.lastID = r.msgLog.MaxID()
+	logDebug(fmt.Sprintf("restored %d of %d messages from %s, last id is %d", len(recs), r.msgLog.Len(), dir, r.lastID))
+	r.logQueue = make(chan msglog.Record, logBacklog)
+	r.logWritten = make(chan struct{})
+	go r.writeLog()
+	return nil
+}
+
+// writeLog appends the messages that the broadcaster of r queues to the message log, since each append waits for the disk to sync it.
+// Once the queue is closed and everything in it is written, the log is closed
+func (r *room) writeLog() {
+	defer close(r.logWritten)
+	for rec := range r.logQueue {
+		err := r.msgLog.Append(rec)
+		if err != nil {
+			log.Println("failed to log message", rec.ID, "in", r.name, err)
+		}
+	}
+	err := r.msgLog.Close()
+	if err != nil {
+		log.Println("failed to close the log of", r.name, err)
+	}
+}
+
+// remember adds m to the history as published at t, and queues it for the message log if there is one
+func (r *room) remember(m *activeMsg, t time.Time) {
+	p := publishedMsg{m.id, m.parent, m.color, m.name, m.key, string(m.text), t, m.author}
+	if r.msgLog != nil {
+		r.logQueue <- msglog.Record{ID: p.id, Parent: p.parent, Color: p.color, Name: p.name, Text: p.text, Time: p.published}
+	}
+	r.keep(p)
+}
+
+// keep adds p to the history, and forgets the oldest message if the history is full
+func (r *room) keep(p publishedMsg) {
+	if historyLen <= 0 {
+		return
+	}
+	if len(r.history) >= historyLen {
+		r.history = append(r.history[:0], r.history[len(r.history)-historyLen+1:]...)
+	}
+	r.history = append(r.history, p)
+}
+
+// replay returns the events that replay every message in the history, marked as replays so that clients can tell them apart.
+// The text of each message is a single insert, which settle splits to fit the frames of the client that it is for
+func (r *room) replay() []snapshotEvt {
+	evts := make([]snapshotEvt, 0, 3*len(r.history))
+	for _, m := range r.history {
+		evts = append(evts, snapshotEvt{m.id, &events.Init{Replay: true, Color: m.color, Parent: m.parent, Key: m.key, Name: m.name}})
+		if m.text != "" {
+			evts = append(evts, snapshotEvt{m.id, &events.Insert{At: 0, Text: m.text}})
+		}
+		evts = append(evts, snapshotEvt{m.id, &events.Pub{Time: m.published}})
+	}
+	return evts
+}
+
+// exists returns true if the message with id is active, in the history, or in the message log
+func (r *room) exists(id uint32) bool {
+	if _, ok := r.activeMsgs[id]; ok {
+		return true
+	}
+	for _, m := range r.history {
+		if m.id == id {
+			return true
+		}
+	}
+	if r.msgLog == nil {
+		return false
+	}
+	_, err := r.msgLog.Get(id)
+	return err == nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import "sync"
+
+// hub owns the state that every connection shares, which is the rooms that someone is in and the ids that clients are known by in presence events.
+// Nothing else is shared: everything in a room belongs to its broadcaster, what a client negotiated belongs to the broadcaster of the room it is in,
+// and which room it is in belongs to its listener. Clients are only handed from one goroutine to another over channels, such as when they move between rooms
+type hub struct {
+	mu         sync.Mutex
+	rooms      map[string]*room
+	closing    map[string]chan struct{} // closing holds a channel for each room that is closing, which is closed once its log is, so that it can be opened again
+	lastUserID uint32
+	auth       Authenticator // auth decides who websocket clients are before they are upgraded, and is never changed
+}
+
+func newHub(auth Authenticator) *hub {
+	return &hub{rooms: make(map[string]*room), closing: make(map[string]chan struct{}), auth: auth}
+}
+
+// enter returns the room called name for a client to join, opening it if it isn't open, and waiting for it to finish closing first if it is closing.
+// Every enter has to be followed by a leave once the client has been removed from the room
+func (h *hub) enter(name string) (*room, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for {
+		closed, ok := h.closing[name]
+		if !ok {
+			break
+		}
+		h.mu.Unlock()
+		<-closed
+		h.mu.Lock()
+	}
+	r, ok := h.rooms[name]
+	if !ok {
+		var err error
+		r, err = openRoom(name)
+		if err != nil {
+			return nil, err
+		}
+		h.rooms[name] = r
+	}
+	r.users++
+	return r, nil
+}
+
+// leave gives up a place in r that was taken by enter. Once the last place is given up, r is closed if it keeps its messages in a log, since they are loaded from it
+// when it is opened again. Rooms that keep their history and topic only in memory stay open, so that they aren't forgotten, as does the default room, since the server holds a place in it.
+// Closing waits for the log writer, so it is done without the lock, so that nobody else waits on the disk to join a room
+func (h *hub) leave(r *room) {
+	h.mu.Lock()
+	r.users--
+	if r.users > 0 || r.msgLog == nil {
+		h.mu.Unlock()
+		return
+	}
+	delete(h.rooms, r.name)
+	closed := make(chan struct{})
+	h.closing[r.name] = closed
+	h.mu.Unlock()
+
+	r.close()
+	logDebug("closed room " + r.name)
+	h.mu.Lock()
+	delete(h.closing, r.name)
+	h.mu.Unlock()
+	close(closed)
+}
+
+// nextUserID returns an id that no other client has had since the server started
+func (h *hub) nextUserID() uint32 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastUserID++
+	return h.lastUserID
+}
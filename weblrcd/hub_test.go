@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	events "weblrc"
+
+	"github.com/gorilla/websocket"
+)
+
+// serveHub serves a new hub on a test server, and returns the hub and the websocket url of the test server.
+// Once the test is over, it waits for every client to leave, and then stops the rooms that are kept open, so that nothing is left using the config of the test
+func serveHub(t *testing.T) (*hub, string) {
+	t.Helper()
+	h := newHub(tokenAuth{})
+	srv := httptest.NewServer(http.HandlerFunc(h.handler))
+	t.Cleanup(func() {
+		srv.Close()
+		waitForRooms(t, h)
+		for _, r := range h.rooms {
+			r.close()
+		}
+	})
+	return h, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// waitForRooms waits until everyone has left every room in h, and every room with a log is closed, which happens once everyone has left it
+func waitForRooms(t *testing.T, h *hub) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		h.mu.Lock()
+		var open []string
+		for name, r := range h.rooms {
+			if r.users > 0 || r.msgLog != nil {
+				open = append(open, fmt.Sprintf("%s with %d users", name, r.users))
+			}
+		}
+		h.mu.Unlock()
+		if len(open) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rooms left over after everyone left: %s", strings.Join(open, ", "))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestStress connects many clients at once, each of which says hello, types and publishes messages, moves between rooms,
+// mutes someone, and then hangs up, often in the middle of a message. Once they are all gone, every room has to be closed.
+// It is meant to be run with -race, which then reports any unsynchronized access to the state of the hub and its rooms
+func TestStress(t *testing.T) {
+	useConfig(t, func(c *config) { c.LogDir = t.TempDir() })
+	h, url := serveHub(t)
+
+	workers, rounds, nRooms := 50, 5, 4
+	if testing.Short() {
+		workers, rounds = 10, 2
+	}
+	var connects, failures, received atomic.Int64
+	var wg sync.WaitGroup
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range rounds {
+				err := session(url, w, r, nRooms, &received)
+				if err != nil {
+					t.Log(err)
+					failures.Add(1)
+					continue
+				}
+				connects.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	t.Logf("%d connects, %d failed, %d events received", connects.Load(), failures.Load(), received.Load())
+	if failures.Load() != 0 {
+		t.Errorf("%d sessions failed", failures.Load())
+	}
+	waitForRooms(t, h)
+}
+
+// session connects once, does a random amount of talking, and hangs up without saying goodbye
+func session(url string, w, r, nRooms int, received *atomic.Int64) error {
+	path := fmt.Sprintf("/ws/room-%d", rand.IntN(nRooms))
+	if rand.IntN(4) == 0 {
+		path = "/ws"
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url+path, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	go func() {
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			received.Add(1)
+		}
+	}()
+
+	v := events.V1
+	send := func(e events.Event) error {
+		f, err := events.Frame(v, e)
+		if err != nil {
+			return err
+		}
+		return conn.WriteMessage(websocket.BinaryMessage, f)
+	}
+	// some clients are old enough to not say hello, so the server catches them up on its own once helloGrace passes
+	if rand.IntN(4) != 0 {
+		if err := send(&events.Ping{Hello: &events.Hello{Version: events.MaxVersion, Caps: ^events.Caps(0)}}); err != nil {
+			return err
+		}
+		// nothing is framed in the newer version until the server agrees to it, so this waits for the hello to be answered
+		time.Sleep(20 * time.Millisecond)
+		v = events.MaxVersion
+	}
+
+	script := []events.Event{&events.Identify{Color: uint8(w), Name: fmt.Sprintf("c%d-%d", w, r)}}
+	for range rand.IntN(4) + 1 {
+		script = append(script, &events.Init{Identified: true}, &events.Insert{At: 0, Text: "hello"}, &events.Insert{At: 5, Text: " there"})
+		switch rand.IntN(4) {
+		case 0:
+			script = append(script, &events.Join{Room: fmt.Sprintf("room-%d", rand.IntN(nRooms))})
+		case 1:
+			script = append(script, &events.MuteUser{ID: uint32(rand.IntN(50) + 1)})
+		case 2:
+			script = append(script, &events.DeleteRange{At: 0, N: 5})
+		}
+		script = append(script, &events.Pub{})
+	}
+	if rand.IntN(2) == 0 {
+		// hang up in the middle of a message
+		script = append(script, &events.Init{Identified: true}, &events.Insert{At: 0, Text: "gone"})
+	}
+	for _, e := range script {
+		if err := send(e); err != nil {
+			return err
+		}
+		time.Sleep(time.Duration(rand.IntN(3)) * time.Millisecond)
+	}
+	return nil
+}
+
+// dial connects a client that says hello in v with caps to the room at path, and returns a function that sends it events and one that reads the next server event.
+// Events are read in V1 until the server answers the hello, and in the version that it agreed to after that
+func dial(t *testing.T, url string, path string, v events.Version, caps events.Caps) (func(events.Event), func() (uint32, events.Event)) {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	sendV, readV := events.V1, events.V1
+	send := func(e events.Event) {
+		t.Helper()
+		f, err := events.Frame(sendV, e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	next := func() (uint32, events.Event) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, f, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := events.Unframe(readV, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, e, err := events.DecodeServerEvent(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ping, ok := e.(*events.Ping); ok && ping.Hello != nil {
+			readV = ping.Hello.Version
+		}
+		return id, e
+	}
+	send(&events.Ping{Hello: &events.Hello{Version: v, Caps: caps}})
+	// the server reads the rest of the client's events in the version that it asked for straight away
+	sendV = events.Negotiate(v, events.MaxVersion)
+	return send, next
+}
+
+// TestInitWhileActive checks that a second init from a client whose message is still active is rejected, instead of starting over the message that everyone sees
+func TestInitWhileActive(t *testing.T) {
+	useConfig(t, nil)
+	_, url := serveHub(t)
+	send, next := dial(t, url, "/ws", events.V1, events.CapErrors)
+	send(&events.Init{Color: 1, Name: "first"})
+	send(&events.Insert{At: 0, Text: "hi"})
+	send(&events.Init{Color: 2, Name: "second"})
+	for {
+		id, e := next()
+		if init, ok := e.(*events.Init); ok && init.Name == "second" {
+			t.Fatal("second init was broadcast")
+		}
+		if err, ok := e.(*events.Error); ok {
+			if err.Code != events.ErrorInvalid || id == 0 {
+				t.Fatalf("second init was rejected with %#v for %d", err, id)
+			}
+			return
+		}
+	}
+}
+
+// TestFanOutFits checks that an insert from a V2 client that is too long for a V1 frame reaches a V1 client with CapMultiInsert in full
+func TestFanOutFits(t *testing.T) {
+	useConfig(t, nil)
+	_, url := serveHub(t)
+	_, next := dial(t, url, "/ws", events.V1, events.CapMultiInsert)
+	agreed(t, next)
+	send, _ := dial(t, url, "/ws", events.V2, events.CapMultiInsert)
+	long := strings.Repeat("lunar ✓ ", 125)
+	send(&events.Init{Color: 1, Name: "big"})
+	send(&events.Insert{At: 0, Text: long})
+	send(&events.Pub{})
+	if got := received(t, next); got != long {
+		t.Fatalf("got %d bytes of the %d that were sent", len(got), len(long))
+	}
+}
+
+// received reads from next until a message is published, and returns its text, which is built from inserts at the end of the message
+func received(t *testing.T, next func() (uint32, events.Event)) string {
+	t.Helper()
+	var text string
+	for {
+		_, e := next()
+		switch e := e.(type) {
+		case *events.Insert:
+			text += e.Text
+		case *events.Pub:
+			return text
+		}
+	}
+}
+
+// TestSnapshotFits checks that a V1 client that joins while a message too long for a V1 frame is active is sent all of its text
+func TestSnapshotFits(t *testing.T) {
+	useConfig(t, nil)
+	_, url := serveHub(t)
+	send, next := dial(t, url, "/ws", events.V2, events.CapMultiInsert)
+	long := strings.Repeat("lunar ✓ ", 125)
+	send(&events.Init{Color: 1, Name: "big"})
+	send(&events.Insert{At: 0, Text: long})
+	// the insert is echoed once the broadcaster has applied it, so the joiner only connects after that
+	agreed(t, next)
+	for {
+		if _, e := next(); e.Type() == events.EventInsert {
+			break
+		}
+	}
+	_, joiner := dial(t, url, "/ws", events.V1, events.CapMultiInsert)
+	// the joiner is caught up straight after its hello is answered, so the pub is only sent once it has been
+	agreed(t, joiner)
+	send(&events.Pub{})
+	if got := received(t, joiner); got != long {
+		t.Fatalf("got %d bytes of the %d that were sent", len(got), len(long))
+	}
+}
+
+// TestReplayFits checks that a V1 client that joins after a message too long for a V1 frame was published is replayed all of its text
+func TestReplayFits(t *testing.T) {
+	useConfig(t, nil)
+	_, url := serveHub(t)
+	send, next := dial(t, url, "/ws", events.V2, events.CapMultiInsert)
+	long := strings.Repeat("lunar ✓ ", 125)
+	send(&events.Init{Color: 1, Name: "big"})
+	send(&events.Insert{At: 0, Text: long})
+	send(&events.Pub{})
+	agreed(t, next)
+	received(t, next)
+	_, joiner := dial(t, url, "/ws", events.V1, events.CapMultiInsert|events.CapHistory)
+	if got := received(t, joiner); got != long {
+		t.Fatalf("got %d bytes of the %d that were published", len(got), len(long))
+	}
+}
+
+// TestRoomRemembers checks that a room remembers its topic and history once everyone has left it, whether it is kept open since it only has them in memory,
+// or it is closed and then opened again from its log
+func TestRoomRemembers(t *testing.T) {
+	for _, logged := range []bool{false, true} {
+		t.Run(fmt.Sprintf("logged=%t", logged), func(t *testing.T) {
+			useConfig(t, func(c *config) {
+				if logged {
+					c.LogDir = t.TempDir()
+				}
+			})
+			h, url := serveHub(t)
+			conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/a", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range []events.Event{
+				&events.Ping{Hello: &events.Hello{Version: events.V1, Caps: events.CapTopic | events.CapMultiInsert}},
+				&events.SetTopic{Topic: "moths"},
+				&events.Init{Color: 1, Name: "luna"},
+				&events.Insert{At: 0, Text: "still here?"},
+				&events.Pub{},
+			} {
+				f, err := events.Frame(events.V1, e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := conn.WriteMessage(websocket.BinaryMessage, f); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// leaving is handled after everything that was sent before it, so everyone has left once the room is empty
+			conn.Close()
+			waitForRooms(t, h)
+
+			_, next := dial(t, url, "/ws/a", events.V1, events.CapTopic|events.CapHistory|events.CapMultiInsert)
+			var topic string
+			for topic == "" {
+				if _, e := next(); e.Type() == events.EventSetTopic {
+					topic = e.(*events.SetTopic).Topic
+				}
+			}
+			if text := received(t, next); topic != "moths" || text != "still here?" {
+				t.Fatalf("rejoined to topic %q and history %q", topic, text)
+			}
+		})
+	}
+}
+
+// TestMuteAbandons checks that muting the author of an active message abandons it for the client that muted them, since its pub will never reach that client
+func TestMuteAbandons(t *testing.T) {
+	useConfig(t, nil)
+	_, url := serveHub(t)
+	mute, next := dial(t, url, "/ws", events.V1, events.CapAbandon)
+	agreed(t, next)
+	send, _ := dial(t, url, "/ws", events.V1, 0)
+	send(&events.Init{Color: 1, Name: "loud"})
+	var id uint32
+	for id == 0 {
+		if mid, e := next(); e.Type() == events.EventInit {
+			id = mid
+		}
+	}
+	mute(&events.MuteUser{ID: id})
+	for {
+		mid, e := next()
+		if e.Type() == events.EventAbandon && mid == id {
+			return
+		}
+	}
+}
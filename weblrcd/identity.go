@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/ed25519"
+	events "weblrc"
+)
+
+// identify sets the nick and color of client, which its identified inits use from then on, and tells the room if they changed.
+// An identity belongs to client, so it follows the client between rooms
+func (r *room) identify(client *Client, color uint8, name string) {
+	if client.color == color && client.name == name {
+		return
+	}
+	client.color, client.name = color, name
+	r.fanOut(nil, &events.UserJoin{Color: color, Name: name}, client.userID)
+}
+
+// nick returns the nick that client has to use instead of name. A client that was authenticated as someone with a nick has to use that nick,
+// and nobody else can use a nick that belongs to someone in the tokens file, so they are left without one instead
+func (c *Client) nick(name string) string {
+	if c.identity != nil && c.identity.Name != "" {
+		return c.identity.Name
+	}
+	if cfg().reserves(name) {
+		return ""
+	}
+	return name
+}
+
+// prove binds client to the key in p if p signs the challenge that client was sent, and tells the room. Each client is only challenged once,
+// right after its hello, so the key that it proves is its key for as long as it is connected, and follows it between rooms
+func (r *room) prove(client *Client, p *events.Prove) {
+	if client.nonce == nil {
+		sendError(client, 0, reject(events.ErrorInvalid, "there is no challenge to prove"))
+		return
+	}
+	c := &events.Challenge{Nonce: client.nonce, Host: client.host}
+	client.nonce = nil
+	if !ed25519.Verify(p.Key, c.Signed(), p.Sig) {
+		sendError(client, 0, reject(events.ErrorInvalid, "the signature doesn't match the challenge"))
+		return
+	}
+	client.key = p.Key
+	r.fanOut(nil, &events.Verified{Key: p.Key}, client.userID)
+}
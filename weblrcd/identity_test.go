@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	events "weblrc"
+)
+
+// agreed reads from next until the server answers the hello, and returns the caps that it agreed to
+func agreed(t *testing.T, next func() (uint32, events.Event)) events.Caps {
+	t.Helper()
+	for {
+		_, e := next()
+		if ping, ok := e.(*events.Ping); ok && ping.Hello != nil {
+			return ping.Hello.Caps
+		}
+	}
+}
+
+// TestNoHostNoChallenge checks that keys can't be proved without -host, since the client would have nothing to check the challenge's host against
+func TestNoHostNoChallenge(t *testing.T) {
+	useConfig(t, nil)
+	_, url := serveHub(t)
+	_, next := dial(t, url, "/ws", events.V1, events.CapSigned|events.CapErrors)
+	if caps := agreed(t, next); caps.Has(events.CapSigned) {
+		t.Fatalf("agreed to %b without a host", caps)
+	}
+}
+
+// TestChallengeHost checks that challenges are for -host rather than the host that the client asked for, and that a client can prove its key by signing one
+func TestChallengeHost(t *testing.T) {
+	useConfig(t, func(c *config) { c.Host = "moth11.net:927" })
+	_, url := serveHub(t)
+	send, next := dial(t, url, "/ws", events.V1, events.CapSigned|events.CapErrors)
+	if caps := agreed(t, next); !caps.Has(events.CapSigned) {
+		t.Fatalf("agreed to %b with a host", caps)
+	}
+	_, e := next()
+	c, ok := e.(*events.Challenge)
+	if !ok {
+		t.Fatalf("got %#v instead of a challenge", e)
+	}
+	if c.Host != "moth11.net:927" {
+		t.Fatalf("challenged for %q", c.Host)
+	}
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send(&events.Prove{Key: pub, Sig: ed25519.Sign(key, c.Signed())})
+	for {
+		_, e := next()
+		if err, ok := e.(*events.Error); ok {
+			t.Fatalf("proving was rejected: %s", err.Reason)
+		}
+		if v, ok := e.(*events.Verified); ok {
+			if !pub.Equal(ed25519.PublicKey(v.Key)) {
+				t.Fatalf("verified %x, want %x", v.Key, pub)
+			}
+			return
+		}
+	}
+}
+
+// TestHostNeedsPort checks that -host has a port, since clients sign challenges for the host and port that they dialed
+func TestHostNeedsPort(t *testing.T) {
+	useConfig(t, nil)
+	c := *cfg()
+	c.Host = "moth11.net"
+	if err := c.validate(); err == nil {
+		t.Error("validated a host without a port")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+	"unicode/utf8"
+	events "weblrc"
+)
+
+// activeMsg is the server's authoritative copy of a message that has been initialized but not yet published
+type activeMsg struct {
+	id     uint32
+	parent uint32
+	color  uint8
+	name   string
+	key    ed25519.PublicKey // key is the key that the author proved that they hold, if they did
+	text   []rune
+	author *Client
+}
+
+// reject returns an error event with code, whose reason is formatted from format and a
+func reject(code events.ErrorCode, format string, a ...any) *events.Error {
+	return &events.Error{Code: code, Reason: fmt.Sprintf(format, a...)}
+}
+
+// checkText rejects text that is not valid UTF-8, or that would make a message of l runes longer than positions can reach
+func checkText(l int, text string) *events.Error {
+	if !utf8.ValidString(text) {
+		return reject(events.ErrorInvalid, "text is not valid utf-8")
+	}
+	if l+utf8.RuneCountInString(text) > math.MaxUint16 {
+		return reject(events.ErrorTooLong, "message would be longer than %d runes", math.MaxUint16)
+	}
+	return nil
+}
+
+// checkRange rejects a range of n runes at at that does not fit inside m
+func (m *activeMsg) checkRange(at uint16, n uint16) *events.Error {
+	if int(at)+int(n) > len(m.text) {
+		return reject(events.ErrorOutOfRange, "%d runes at %d is past the end of message %d, which is %d runes", n, at, m.id, len(m.text))
+	}
+	return nil
+}
+
+// apply validates an edit to m, and applies it if it is valid. Otherwise m is unchanged and the error says why
+func (m *activeMsg) apply(e events.Event) *events.Error {
+	switch e := e.(type) {
+	case *events.Init:
+		m.color, m.name, m.parent, m.key = e.Color, e.Name, e.Parent, e.Key
+	case *events.Insert:
+		if e.Text == "" {
+			return reject(events.ErrorInvalid, "insert has no text")
+		}
+		if int(e.At) > len(m.text) {
+			return reject(events.ErrorOutOfRange, "insert at %d is past the end of message %d, which is %d runes", e.At, m.id, len(m.text))
+		}
+		if err := checkText(len(m.text), e.Text); err != nil {
+			return err
+		}
+		m.text = slices.Insert(m.text, int(e.At), []rune(e.Text)...)
+	case *events.Delete:
+		if e.At == 0 {
+			return reject(events.ErrorOutOfRange, "delete at 0 has nothing before it")
+		}
+		if int(e.At) > len(m.text) {
+			return reject(events.ErrorOutOfRange, "delete at %d is past the end of message %d, which is %d runes", e.At, m.id, len(m.text))
+		}
+		m.text = slices.Delete(m.text, int(e.At)-1, int(e.At))
+	case *events.DeleteRange:
+		if e.N == 0 {
+			return reject(events.ErrorInvalid, "delete range has no runes")
+		}
+		if err := m.checkRange(e.At, e.N); err != nil {
+			return err
+		}
+		m.text = slices.Delete(m.text, int(e.At), int(e.At)+int(e.N))
+	case *events.Replace:
+		if err := m.checkRange(e.At, e.N); err != nil {
+			return err
+		}
+		if err := checkText(len(m.text)-int(e.N), e.Text); err != nil {
+			return err
+		}
+		m.text = slices.Replace(m.text, int(e.At), int(e.At)+int(e.N), []rune(e.Text)...)
+	case *events.Pub:
+	default:
+		return reject(events.ErrorInvalid, "%s events cannot edit a message", e.Type())
+	}
+	return nil
+}
+
+// snapshotEvt is an event that recreates part of a message for a client that just joined
+type snapshotEvt struct {
+	id  uint32
+	evt events.Event
+}
+
+// snapshot returns an init and an insert for every active message, in the order that they were initialized
+func (r *room) snapshot() []snapshotEvt {
+	ids := make([]uint32, 0, len(r.activeMsgs))
+	for id := range r.activeMsgs {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	evts := make([]snapshotEvt, 0, 2*len(ids))
+	for _, id := range ids {
+		m := r.activeMsgs[id]
+		evts = append(evts, snapshotEvt{id, &events.Init{Color: m.color, Parent: m.parent, Key: m.key, Name: m.name}})
+		if len(m.text) != 0 {
+			evts = append(evts, snapshotEvt{id, &events.Insert{At: 0, Text: string(m.text)}})
+		}
+	}
+	return evts
+}
+
+// finish ends the active message of client, which is leaving r, so that nobody is left watching a message that will never be published.
+// Messages with text are published, unless -abandon is set, and the rest are abandoned
+func (r *room) finish(client *Client) {
+	id := r.clientToID[client]
+	m, ok := r.activeMsgs[id]
+	if !ok {
+		return
+	}
+	delete(r.activeMsgs, id)
+	if len(m.text) == 0 || cfg().Abandon {
+		r.fanOut(client, &events.Abandon{}, id)
+		return
+	}
+	t := time.Now()
+	r.remember(m, t)
+	r.fanOut(client, &events.Pub{Time: t}, id)
+}
@@ -0,0 +1,292 @@
+// Package msglog is an append only log of published messages, kept on disk in a directory of segment files.
+// Each record is checked by a crc, and a new segment is started once the last one is full.
+// The index of records by id and by time is kept in memory, and rebuilt from the segments when the log is opened.
+// A record that was only partly written when the process died is cut off the end of the log when it is opened
+package msglog
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultSegmentSize is how large a segment grows before a new one is started, unless the log is opened with another size
+const DefaultSegmentSize = 4 << 20
+
+// segment is one file of the log. Every segment is kept open for reading, and only the last one is written to
+type segment struct {
+	f    *os.File
+	size int64
+}
+
+// entry is where a record is in the log
+type entry struct {
+	id   uint32
+	time int64 // time is in unix millis
+	seg  int
+	off  int64
+	len  int
+}
+
+// Log is an append only log of published messages. It is safe to use from several goroutines
+type Log struct {
+	mu          sync.Mutex
+	dir         string
+	segmentSize int64
+	segs        []*segment
+	entries     []entry        // entries holds every record in the order that it was appended, which is also the order of their times
+	byID        map[uint32]int // byID maps the id of each record to its entry
+	maxID       uint32
+	buf         []byte
+}
+
+// Open opens the log in dir, creating dir if it doesn't exist, and rebuilds the index from its segments.
+// Segments grow up to segmentSize bytes, or DefaultSegmentSize if segmentSize is 0
+func Open(dir string, segmentSize int64) (*Log, error) {
+	if segmentSize <= 0 {
+		segmentSize = DefaultSegmentSize
+	}
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	l := &Log{dir: dir, segmentSize: segmentSize, byID: make(map[uint32]int)}
+	for i, name := range names {
+		err = l.recover(name, i == len(names)-1)
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if len(l.segs) == 0 {
+		err = l.rotate()
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// recover opens the segment at name and indexes its records. If it is the last segment, anything after its last whole record is truncated,
+// since that can only be a record that was being written when the process died. Any other segment was finished, so a bad record in it is an error
+func (l *Log) recover(name string, last bool) error {
+	flag := os.O_RDONLY
+	if last {
+		flag = os.O_RDWR
+	}
+	f, err := os.OpenFile(name, flag, 0)
+	if err != nil {
+		return err
+	}
+	s := &segment{f: f}
+	l.segs = append(l.segs, s)
+	seg := len(l.segs) - 1
+	header := make([]byte, headerLen)
+	var off int64
+	for {
+		r, n, err := readRecord(f, off, header)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if !last {
+				return fmt.Errorf("%s at %d: %w", name, off, err)
+			}
+			err = f.Truncate(off)
+			if err != nil {
+				return err
+			}
+			break
+		}
+		l.index(r, seg, off, n)
+		off += int64(n)
+	}
+	s.size = off
+	if last {
+		_, err = f.Seek(off, io.SeekStart)
+	}
+	return err
+}
+
+// readRecord reads the record at off in f, and how many bytes it takes up. It returns io.EOF if there is nothing at off,
+// and io.ErrUnexpectedEOF if the record at off was only partly written
+func readRecord(f *os.File, off int64, header []byte) (Record, int, error) {
+	_, err := f.ReadAt(header, off)
+	if err != nil {
+		if err == io.EOF {
+			n, _ := f.ReadAt(header[:1], off)
+			if n != 0 {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		return Record{}, 0, err
+	}
+	bl, err := bodyLen(header)
+	if err != nil {
+		return Record{}, 0, err
+	}
+	body := make([]byte, bl)
+	_, err = f.ReadAt(body, off+headerLen)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return Record{}, 0, err
+	}
+	r, err := parseRecord(header, body)
+	return r, headerLen + bl, err
+}
+
+func (l *Log) index(r Record, seg int, off int64, n int) {
+	l.byID[r.ID] = len(l.entries)
+	l.entries = append(l.entries, entry{r.ID, r.Time.UnixMilli(), seg, off, n})
+	l.maxID = max(l.maxID, r.ID)
+}
+
+// rotate starts a new segment, which is written to from then on
+func (l *Log) rotate() error {
+	if len(l.segs) != 0 {
+		err := l.segs[len(l.segs)-1].f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	name := filepath.Join(l.dir, fmt.Sprintf("%08d.seg", len(l.segs)))
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	l.segs = append(l.segs, &segment{f: f})
+	return nil
+}
+
+// Append writes r to the end of the log and syncs it to disk. If r is older than the last record, it is logged at the time of the last record instead,
+// so that the log stays in order of time even if the clock goes backwards
+func (l *Log) Append(r Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.segs == nil {
+		return os.ErrClosed
+	}
+	if _, ok := l.byID[r.ID]; ok {
+		return fmt.Errorf("record %d is already in the log", r.ID)
+	}
+	if len(l.entries) != 0 {
+		if prev := l.entries[len(l.entries)-1].time; r.Time.UnixMilli() < prev {
+			r.Time = time.UnixMilli(prev)
+		}
+	}
+	var err error
+	l.buf, err = appendRecord(l.buf[:0], r)
+	if err != nil {
+		return err
+	}
+	s := l.segs[len(l.segs)-1]
+	if s.size != 0 && s.size+int64(len(l.buf)) > l.segmentSize {
+		err = l.rotate()
+		if err != nil {
+			return err
+		}
+		s = l.segs[len(l.segs)-1]
+	}
+	_, err = s.f.Write(l.buf)
+	if err != nil {
+		// cut off whatever part of the record made it, so that the next one isn't written after it
+		s.f.Truncate(s.size)
+		s.f.Seek(s.size, io.SeekStart)
+		return err
+	}
+	err = s.f.Sync()
+	if err != nil {
+		return err
+	}
+	l.index(r, len(l.segs)-1, s.size, len(l.buf))
+	s.size += int64(len(l.buf))
+	return nil
+}
+
+// read reads the record at e
+func (l *Log) read(e entry) (Record, error) {
+	r, _, err := readRecord(l.segs[e.seg].f, e.off, make([]byte, headerLen))
+	return r, err
+}
+
+// readEntries reads the records at es
+func (l *Log) readEntries(es []entry) ([]Record, error) {
+	rs := make([]Record, 0, len(es))
+	for _, e := range es {
+		r, err := l.read(e)
+		if err != nil {
+			return rs, err
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// Get returns the record with id, or ErrNotFound if there isn't one
+func (l *Log) Get(id uint32) (Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	i, ok := l.byID[id]
+	if !ok {
+		return Record{}, fmt.Errorf("%w: %d", ErrNotFound, id)
+	}
+	return l.read(l.entries[i])
+}
+
+// Last returns up to the last n records, oldest first
+func (l *Log) Last(n int) ([]Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.readEntries(l.entries[max(len(l.entries)-n, 0):])
+}
+
+// Since returns every record published at or after t, oldest first
+func (l *Log) Since(t time.Time) ([]Record, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ms := t.UnixMilli()
+	i := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].time >= ms })
+	return l.readEntries(l.entries[i:])
+}
+
+// Len returns how many records are in the log
+func (l *Log) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.entries)
+}
+
+// MaxID returns the largest id in the log, or 0 if it is empty
+func (l *Log) MaxID() uint32 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.maxID
+}
+
+// Close syncs the last segment, and closes every segment
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var errs []error
+	if len(l.segs) != 0 {
+		errs = append(errs, l.segs[len(l.segs)-1].f.Sync())
+	}
+	for _, s := range l.segs {
+		errs = append(errs, s.f.Close())
+	}
+	l.segs = nil
+	return errors.Join(errs...)
+}
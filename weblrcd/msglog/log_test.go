@@ -0,0 +1,269 @@
+package msglog
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var epoch = time.UnixMilli(1700000000000)
+
+// rec returns the record with id that the tests append, which was published id seconds after epoch
+func rec(id uint32) Record {
+	return Record{ID: id, Parent: id / 2, Color: uint8(id), Name: fmt.Sprintf("user%d", id), Text: fmt.Sprintf("message %d ✓", id), Time: epoch.Add(time.Duration(id) * time.Second)}
+}
+
+func sameRecord(a, b Record) bool {
+	return a.ID == b.ID && a.Parent == b.Parent && a.Color == b.Color && a.Name == b.Name && a.Text == b.Text && a.Time.Equal(b.Time)
+}
+
+func appendAll(t *testing.T, l *Log, from, to uint32) {
+	t.Helper()
+	for id := from; id <= to; id++ {
+		if err := l.Append(rec(id)); err != nil {
+			t.Fatalf("appending %d: %s", id, err)
+		}
+	}
+}
+
+// checkIndex checks that l holds exactly the records from 1 to n, and finds each of them by id and by time
+func checkIndex(t *testing.T, l *Log, n uint32) {
+	t.Helper()
+	if l.Len() != int(n) || l.MaxID() != n {
+		t.Fatalf("log has %d records up to %d, want %d", l.Len(), l.MaxID(), n)
+	}
+	for id := uint32(1); id <= n; id++ {
+		r, err := l.Get(id)
+		if err != nil {
+			t.Fatalf("getting %d: %s", id, err)
+		}
+		if !sameRecord(r, rec(id)) {
+			t.Fatalf("got %+v, want %+v", r, rec(id))
+		}
+	}
+	if _, err := l.Get(n + 1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("getting %d gave %v, want %v", n+1, err, ErrNotFound)
+	}
+	from := max(n/2, 1)
+	since, err := l.Since(rec(from).Time)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int(n) - int(from) + 1; len(since) != max(want, 0) || (n > 0 && !sameRecord(since[0], rec(from))) {
+		t.Fatalf("got %d records since %d, want %d", len(since), from, want)
+	}
+	last, err := l.Last(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(last) != min(3, int(n)) || (n > 0 && !sameRecord(last[len(last)-1], rec(n))) {
+		t.Fatalf("got %d last records, ending with %+v", len(last), last)
+	}
+}
+
+// segments returns the segment files in dir, in order
+func segments(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestAppendAndReopen(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIndex(t, l, 0)
+	appendAll(t, l, 1, 20)
+	checkIndex(t, l, 20)
+	if err := l.Append(rec(20)); err == nil {
+		t.Error("appended the same id twice")
+	}
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Append(rec(21)); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("appending to a closed log gave %v, want %v", err, os.ErrClosed)
+	}
+
+	l, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	checkIndex(t, l, 20)
+	appendAll(t, l, 21, 25)
+	checkIndex(t, l, 25)
+}
+
+// TestCrashRecovery opens the log again without closing it, as happens after the process dies, and checks that every appended record survived
+func TestCrashRecovery(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendAll(t, l, 1, 10)
+
+	l2, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l2.Close()
+	checkIndex(t, l2, 10)
+}
+
+// TestTornLastRecord cuts the last record in half, as if the process died while writing it, and checks that it is cut off when the log is opened
+// and that the next record is written where it was
+func TestTornLastRecord(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, l, 1, 5)
+	l.Close()
+
+	names := segments(t, dir)
+	fi, err := os.Stat(names[len(names)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cut := range []int64{3, headerLen + 2} {
+		b, err := appendRecord(nil, rec(6))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.OpenFile(names[len(names)-1], os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(b[:cut])
+		f.Close()
+
+		l, err = Open(dir, 0)
+		if err != nil {
+			t.Fatalf("cut %d bytes into the record: %s", cut, err)
+		}
+		checkIndex(t, l, 5)
+		l.Close()
+		if after, _ := os.Stat(names[len(names)-1]); after.Size() != fi.Size() {
+			t.Fatalf("cut %d bytes into the record: the segment is %d bytes, want %d", cut, after.Size(), fi.Size())
+		}
+	}
+
+	l, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, l, 6, 7)
+	l.Close()
+	l, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	checkIndex(t, l, 7)
+}
+
+// TestCorruptLastRecord flips a byte of the last record, which is cut off like a torn one since the crc doesn't match
+func TestCorruptLastRecord(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, l, 1, 3)
+	l.Close()
+
+	name := segments(t, dir)[0]
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[len(b)-1] ^= 0xff
+	if err := os.WriteFile(name, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l, err = Open(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	checkIndex(t, l, 2)
+}
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	l, err := Open(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendAll(t, l, 1, 12)
+	checkIndex(t, l, 12)
+	l.Close()
+	names := segments(t, dir)
+	if len(names) < 3 {
+		t.Fatalf("12 records made %d segments of 100 bytes", len(names))
+	}
+	for _, name := range names[:len(names)-1] {
+		if fi, err := os.Stat(name); err != nil || fi.Size() > 100 {
+			t.Fatalf("%s is larger than a segment: %v", name, err)
+		}
+	}
+
+	l, err = Open(dir, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIndex(t, l, 12)
+	appendAll(t, l, 13, 15)
+	checkIndex(t, l, 15)
+	l.Close()
+
+	// a bad record in a segment that isn't the last one can't be a torn write, so the log refuses to open
+	if err := os.Truncate(names[0], 10); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := Open(dir, 100); err == nil {
+		l.Close()
+		t.Fatal("opened a log whose first segment is corrupt")
+	}
+}
+
+// TestClockGoesBackwards checks that a record older than the last one is logged at the time of the last one, so that Since stays in order
+func TestClockGoesBackwards(t *testing.T) {
+	l, err := Open(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	appendAll(t, l, 1, 2)
+	old := rec(3)
+	old.Time = epoch
+	if err := l.Append(old); err != nil {
+		t.Fatal(err)
+	}
+	r, err := l.Get(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Time.Equal(rec(2).Time) {
+		t.Errorf("record from before the last one was logged at %s, want %s", r.Time, rec(2).Time)
+	}
+	since, err := l.Since(rec(2).Time)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(since) != 2 {
+		t.Errorf("got %d records since the last one, want 2", len(since))
+	}
+}
@@ -0,0 +1,78 @@
+package msglog
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+// Record is a published message, as it is kept in the log
+type Record struct {
+	ID     uint32
+	Parent uint32 // Parent is the id of the message that this one replies to, or 0 if it isn't a reply
+	Color  uint8
+	Name   string
+	Text   string
+	Time   time.Time
+}
+
+var (
+	ErrCorrupt  = errors.New("corrupt record")
+	ErrNotFound = errors.New("no such record")
+)
+
+const (
+	headerLen  = 8 // headerLen is the length of a record's header, which is the length of its body and the crc of its body, both as big endian uint32s
+	bodyMinLen = 4 + 8 + 4 + 1 + 1
+	maxBodyLen = 1 << 20 // maxBodyLen is far longer than any message can be, so that a garbage length is caught before it is read
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// appendRecord appends r to dst as a header followed by its body, which is
+// [id uint32][unix millis int64][parent uint32][color uint8][name length uint8][name][text]
+func appendRecord(dst []byte, r Record) ([]byte, error) {
+	if len(r.Name) > 0xff {
+		return dst, fmt.Errorf("name is %d bytes, longer than %d", len(r.Name), 0xff)
+	}
+	body := binary.BigEndian.AppendUint32(make([]byte, 0, bodyMinLen+len(r.Name)+len(r.Text)), r.ID)
+	body = binary.BigEndian.AppendUint64(body, uint64(r.Time.UnixMilli()))
+	body = binary.BigEndian.AppendUint32(body, r.Parent)
+	body = append(body, r.Color, byte(len(r.Name)))
+	body = append(body, r.Name...)
+	body = append(body, r.Text...)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(body)))
+	dst = binary.BigEndian.AppendUint32(dst, crc32.Checksum(body, crcTable))
+	return append(dst, body...), nil
+}
+
+// bodyLen returns the length of the body that header says follows it
+func bodyLen(header []byte) (int, error) {
+	l := binary.BigEndian.Uint32(header)
+	if l < bodyMinLen || l > maxBodyLen {
+		return 0, fmt.Errorf("%w: body length %d", ErrCorrupt, l)
+	}
+	return int(l), nil
+}
+
+// parseRecord checks body against the crc in header, and parses it
+func parseRecord(header []byte, body []byte) (Record, error) {
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+		return Record{}, fmt.Errorf("%w: crc mismatch", ErrCorrupt)
+	}
+	r := Record{
+		ID:     binary.BigEndian.Uint32(body),
+		Time:   time.UnixMilli(int64(binary.BigEndian.Uint64(body[4:]))),
+		Parent: binary.BigEndian.Uint32(body[12:]),
+		Color:  body[16],
+	}
+	nl := int(body[17])
+	if bodyMinLen+nl > len(body) {
+		return Record{}, fmt.Errorf("%w: name length %d is past the end of the body", ErrCorrupt, nl)
+	}
+	r.Name = string(body[bodyMinLen : bodyMinLen+nl])
+	r.Text = string(body[bodyMinLen+nl:])
+	return r, nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import events "weblrc"
+
+// authorOf returns the client that wrote the message with id, if it is active or still in the history
+func (r *room) authorOf(id uint32) *Client {
+	if m, ok := r.activeMsgs[id]; ok {
+		return m.author
+	}
+	for i := len(r.history) - 1; i >= 0; i-- {
+		if r.history[i].id == id {
+			return r.history[i].author
+		}
+	}
+	return nil
+}
+
+// mute stops sending client the events of the author of the message with id if muted is set, and starts sending them again otherwise.
+// Mutes belong to client, so they follow it between rooms, and end when either of them disconnects.
+// Since client won't see the pub of the author's active message, it is abandoned for client instead
+func (r *room) mute(client *Client, id uint32, muted bool) {
+	author := r.authorOf(id)
+	if author == nil {
+		sendError(client, id, reject(events.ErrorNoMessage, "the author of message %d is unknown, since it is neither active nor in the history", id))
+		return
+	}
+	if author == client {
+		sendError(client, id, reject(events.ErrorInvalid, "cannot mute yourself"))
+		return
+	}
+	if !muted {
+		delete(client.muted, author)
+		return
+	}
+	if client.muted == nil {
+		client.muted = make(map[*Client]bool)
+	}
+	client.muted[author] = true
+	active := r.clientToID[author]
+	if active == 0 {
+		return
+	}
+	p := peer{client.version, client.caps}
+	for _, de := range p.downgrade(&events.Abandon{}) {
+		se, err := events.MarshalServerEvent(p.version, de, active)
+		if err == nil {
+			client.send(se)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"sync"
+	"time"
+	"unicode/utf8"
+	events "weblrc"
+
+	"github.com/gorilla/websocket"
+)
+
+// outbox is the queue of server events that are waiting to be written to a client. The broadcaster pushes to it without ever blocking,
+// and the client's writer takes everything in it at once, so a client that is behind gets its events in larger and larger batches.
+// A client is slow while more than -backlog events are waiting for it, and its inserts are merged into the insert before them while they wait
+type outbox struct {
+	mu        sync.Mutex
+	queue     []queued
+	ready     chan struct{} // ready has a value whenever the queue may have something in it, or the outbox was closed
+	slowSince time.Time     // slowSince is when the client last went over -backlog, or zero if it is keeping up
+	evicted   bool          // evicted is set once the client is being disconnected, after which nothing more is queued
+	closed    bool
+}
+
+// queued is a server event that is waiting to be written. ins is set on inserts to clients with CapMultiInsert,
+// which are the only events that can be merged, and v is the version that se was framed in.
+// pm is se prepared as a websocket message, if it was fanned out. It is shared by every client that gets se, so that se is only framed for websockets once
+type queued struct {
+	se  events.LRCServerEvent
+	id  uint32
+	ins *events.Insert
+	v   events.Version
+	pm  *websocket.PreparedMessage
+}
+
+func newOutbox() *outbox {
+	return &outbox{ready: make(chan struct{}, 1)}
+}
+
+// push queues q, merging it into the event before it if they are inserts that make a single run. It returns how many events are waiting,
+// and how long the client has been slow for, which is zero if it is keeping up with backlog
+func (o *outbox) push(q queued, backlog int) (int, time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.evicted || o.closed {
+		return 0, 0
+	}
+	if n := len(o.queue); n == 0 || !o.merge(&o.queue[n-1], q) {
+		o.queue = append(o.queue, q)
+	}
+	o.wake()
+	if len(o.queue) <= backlog {
+		o.slowSince = time.Time{}
+		return len(o.queue), 0
+	}
+	if o.slowSince.IsZero() {
+		o.slowSince = time.Now()
+	}
+	return len(o.queue), time.Since(o.slowSince)
+}
+
+// merge merges q into last if q inserts into the same message right where last ends, since nobody has seen last yet.
+// Inserts that would be too long to frame together are left alone
+func (o *outbox) merge(last *queued, q queued) bool {
+	if last.ins == nil || q.ins == nil || last.id != q.id || last.v != q.v {
+		return false
+	}
+	if int(q.ins.At) != int(last.ins.At)+utf8.RuneCountInString(last.ins.Text) {
+		return false
+	}
+	ins := &events.Insert{At: last.ins.At, Text: last.ins.Text + q.ins.Text}
+	se, err := events.MarshalServerEvent(q.v, ins, q.id)
+	if err != nil {
+		return false
+	}
+	last.se, last.ins, last.pm = se, ins, nil
+	return true
+}
+
+// evict drops everything that is waiting for the client, and queues last instead, if there is a last, after which the writer disconnects the client.
+// It returns false if the client was already evicted
+func (o *outbox) evict(last events.LRCServerEvent) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.evicted {
+		return false
+	}
+	o.queue = o.queue[:0]
+	if last != nil {
+		o.queue = append(o.queue, queued{se: last})
+	}
+	o.evicted = true
+	o.wake()
+	return true
+}
+
+// close drops everything that is waiting, since the client is gone, and stops the writer
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.queue = nil
+	o.closed = true
+	o.wake()
+}
+
+// wake lets the writer know that there is something to do, and must be called with mu held
+func (o *outbox) wake() {
+	select {
+	case o.ready <- struct{}{}:
+	default:
+	}
+}
+
+// take waits until something is waiting, and returns all of it, along with whether the client was evicted.
+// It returns false once the outbox is closed
+func (o *outbox) take(batch []queued) ([]queued, bool, bool) {
+	for {
+		o.mu.Lock()
+		if o.closed {
+			o.mu.Unlock()
+			return nil, false, false
+		}
+		if len(o.queue) > 0 || o.evicted {
+			batch = append(batch[:0], o.queue...)
+			o.queue = o.queue[:0]
+			o.slowSince = time.Time{}
+			evicted := o.evicted
+			o.mu.Unlock()
+			return batch, evicted, true
+		}
+		o.mu.Unlock()
+		<-o.ready
+	}
+}
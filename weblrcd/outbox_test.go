@@ -0,0 +1,225 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+	events "weblrc"
+)
+
+// useConfig makes the defaults, changed by set, the config for the rest of t
+func useConfig(t *testing.T, set func(c *config)) {
+	t.Helper()
+	c := &config{}
+	bind(flag.NewFlagSet(t.Name(), flag.ContinueOnError), c)
+	c.LogLevel = "info"
+	if set != nil {
+		set(c)
+	}
+	if err := c.validate(); err != nil {
+		t.Fatal(err)
+	}
+	old := current.Load()
+	current.Store(c)
+	t.Cleanup(func() { current.Store(old) })
+}
+
+// insert returns an insert into the message id that is queued for a client with CapMultiInsert that speaks v
+func insert(t *testing.T, v events.Version, id uint32, at uint16, text string) queued {
+	t.Helper()
+	ins := &events.Insert{At: at, Text: text}
+	se, err := events.MarshalServerEvent(v, ins, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queued{se: se, id: id, ins: ins, v: v}
+}
+
+// decodeQueued returns the id and the event that q was framed from
+func decodeQueued(t *testing.T, q queued) (uint32, events.Event) {
+	t.Helper()
+	data, err := events.Unframe(q.v, q.se)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, e, err := events.DecodeServerEvent(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, e
+}
+
+// texts returns the text of every insert waiting in o, and "-" for anything else
+func texts(o *outbox) []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var ts []string
+	for _, q := range o.queue {
+		if q.ins == nil {
+			ts = append(ts, "-")
+			continue
+		}
+		ts = append(ts, q.ins.Text)
+	}
+	return ts
+}
+
+func TestMergeContiguousInserts(t *testing.T) {
+	del, err := events.MarshalServerEvent(events.V2, &events.Delete{At: 1}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unmergeable := insert(t, events.V2, 1, 4, "x")
+	unmergeable.ins = nil
+	for _, tc := range []struct {
+		name string
+		push []queued
+		want []string
+	}{
+		{"contiguous", []queued{insert(t, events.V2, 1, 0, "ab"), insert(t, events.V2, 1, 2, "cd"), insert(t, events.V2, 1, 4, "é")}, []string{"abcdé"}},
+		{"gap", []queued{insert(t, events.V2, 1, 0, "ab"), insert(t, events.V2, 1, 3, "cd")}, []string{"ab", "cd"}},
+		{"before", []queued{insert(t, events.V2, 1, 2, "ab"), insert(t, events.V2, 1, 2, "cd")}, []string{"ab", "cd"}},
+		{"other message", []queued{insert(t, events.V2, 1, 0, "ab"), insert(t, events.V2, 2, 2, "cd")}, []string{"ab", "cd"}},
+		{"other version", []queued{insert(t, events.V2, 1, 0, "ab"), insert(t, events.V1, 1, 2, "cd")}, []string{"ab", "cd"}},
+		{"after a delete", []queued{insert(t, events.V2, 1, 0, "ab"), {se: del, id: 1, v: events.V2}, insert(t, events.V2, 1, 1, "cd")}, []string{"ab", "-", "cd"}},
+		{"without multi insert", []queued{insert(t, events.V2, 1, 0, "abcd"), unmergeable}, []string{"abcd", "-"}},
+	} {
+		o := newOutbox()
+		for _, q := range tc.push {
+			o.push(q, 100)
+		}
+		if got := texts(o); strings.Join(got, "|") != strings.Join(tc.want, "|") {
+			t.Errorf("%s: queued %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	o := newOutbox()
+	o.push(insert(t, events.V1, 7, 3, "ab"), 100)
+	o.push(insert(t, events.V1, 7, 5, "cd"), 100)
+	batch, _, _ := o.take(nil)
+	if id, e := decodeQueued(t, batch[0]); id != 7 || e.(*events.Insert).At != 3 || e.(*events.Insert).Text != "abcd" {
+		t.Errorf("merged insert was framed as %d %#v", id, e)
+	}
+	if batch[0].pm != nil {
+		t.Error("merged insert kept the prepared message of the first insert")
+	}
+}
+
+// TestNoMergePastFrameLimit checks that inserts that would be too long to frame together in V1 are left apart, while V2 can still merge them
+func TestNoMergePastFrameLimit(t *testing.T) {
+	a, b := strings.Repeat("a", 200), strings.Repeat("b", 100)
+	o := newOutbox()
+	o.push(insert(t, events.V1, 1, 0, a), 100)
+	o.push(insert(t, events.V1, 1, 200, b), 100)
+	if got := texts(o); len(got) != 2 {
+		t.Errorf("V1 merged inserts past the frame limit into %d events", len(got))
+	}
+	o = newOutbox()
+	o.push(insert(t, events.V2, 1, 0, a), 100)
+	o.push(insert(t, events.V2, 1, 200, b), 100)
+	if got := texts(o); len(got) != 1 || got[0] != a+b {
+		t.Errorf("V2 didn't merge inserts that fit in its frames")
+	}
+}
+
+// evicted takes what is waiting for client, and checks that it was evicted with just an evicted error waiting
+func evicted(t *testing.T, client *Client) {
+	t.Helper()
+	batch, wasEvicted, ok := client.out.take(nil)
+	if !ok || !wasEvicted || len(batch) != 1 {
+		t.Fatalf("took %d events, evicted %t, open %t", len(batch), wasEvicted, ok)
+	}
+	if _, e := decodeQueued(t, queued{se: batch[0].se, v: client.version}); e.(*events.Error).Code != events.ErrorEvicted {
+		t.Errorf("evicted with %#v", e)
+	}
+	if n, _ := client.out.push(insert(t, client.version, 1, 0, "a"), 1); n != 0 {
+		t.Error("queued an event for an evicted client")
+	}
+}
+
+func TestEvictAfterMaxBacklog(t *testing.T) {
+	useConfig(t, func(c *config) { c.Backlog, c.MaxBacklog, c.Grace = 2, 4, duration(time.Hour) })
+	r := &room{}
+	client := &Client{out: newOutbox(), version: events.V2, caps: events.CapErrors}
+	for i := range 4 {
+		if !r.trySend(client, queued{se: []byte{byte(i)}}) {
+			t.Fatalf("evicted after %d events", i+1)
+		}
+	}
+	if r.trySend(client, queued{se: []byte{4}}) {
+		t.Fatal("didn't evict after the max backlog")
+	}
+	evicted(t, client)
+}
+
+func TestEvictAfterGrace(t *testing.T) {
+	useConfig(t, func(c *config) { c.Backlog, c.MaxBacklog, c.Grace = 1, 100, duration(50*time.Millisecond) })
+	r := &room{}
+	client := &Client{out: newOutbox(), version: events.V2, caps: events.CapErrors}
+
+	// a client that catches up in time isn't slow anymore
+	r.trySend(client, queued{se: []byte{1}})
+	r.trySend(client, queued{se: []byte{2}})
+	time.Sleep(30 * time.Millisecond)
+	client.out.take(nil)
+	time.Sleep(30 * time.Millisecond)
+	r.trySend(client, queued{se: []byte{3}})
+	if !r.trySend(client, queued{se: []byte{4}}) {
+		t.Fatal("evicted a client that caught up")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if r.trySend(client, queued{se: []byte{5}}) {
+		t.Fatal("didn't evict a client that was slow for longer than the grace")
+	}
+	evicted(t, client)
+}
+
+func TestTakeAfterEvict(t *testing.T) {
+	o := newOutbox()
+	o.push(queued{se: []byte{1}}, 100)
+	if !o.evict(nil) {
+		t.Fatal("evict failed")
+	}
+	if o.evict([]byte{2}) {
+		t.Error("evicted twice")
+	}
+	batch, wasEvicted, ok := o.take(nil)
+	if len(batch) != 0 || !wasEvicted || !ok {
+		t.Errorf("took %d events, evicted %t, open %t", len(batch), wasEvicted, ok)
+	}
+	o.close()
+	if _, _, ok := o.take(nil); ok {
+		t.Error("took from a closed outbox")
+	}
+}
+
+// TestTakeWaits checks that take waits for something to be pushed, and that closing the outbox stops it
+func TestTakeWaits(t *testing.T) {
+	o := newOutbox()
+	took := make(chan int)
+	go func() {
+		for {
+			batch, _, ok := o.take(nil)
+			if !ok {
+				close(took)
+				return
+			}
+			took <- len(batch)
+		}
+	}()
+	select {
+	case n := <-took:
+		t.Fatalf("took %d events from an empty outbox", n)
+	case <-time.After(20 * time.Millisecond):
+	}
+	o.push(queued{se: []byte{1}}, 100)
+	if n := <-took; n != 1 {
+		t.Errorf("took %d events, want 1", n)
+	}
+	o.close()
+	if _, ok := <-took; ok {
+		t.Error("take didn't stop once the outbox closed")
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"cmp"
+	"path/filepath"
+	"slices"
+	"time"
+	events "weblrc"
+	"weblrcd/msglog"
+)
+
+// room is a channel that clients talk in. Each room has its own clients, ids, messages, history, and broadcaster,
+// so nothing that happens in one room is seen in another. Everything in a room other than its name, its channels and its log belongs to its broadcaster,
+// and is only touched from it, which is why none of it is locked. The log is set when the room is opened and never changes
+type room struct {
+	name         string
+	clients      map[*Client]bool
+	clientToID   map[*Client]uint32
+	lastID       uint32
+	eventChannel chan Evt
+	joinChannel  chan *Client
+	settleChan   chan *Client
+	quit         chan struct{}         // quit is closed to stop the broadcaster, once everyone has left
+	stopped      chan struct{}         // stopped is closed once the broadcaster has stopped
+	users        int                   // users is how many clients are in the room or on their way into it, which belongs to the hub rather than the broadcaster
+	activeMsgs   map[uint32]*activeMsg // activeMsgs holds every active message by its id
+	history      []publishedMsg        // history holds the most recently published messages, oldest first
+	msgLog       *msglog.Log           // msgLog is where published messages are kept on disk, or nil if they are only kept in memory
+	logQueue     chan msglog.Record    // logQueue holds published messages on their way to the log writer, so that the broadcaster never waits on the disk
+	logWritten   chan struct{}         // logWritten is closed once the log writer has written everything in logQueue and closed the log
+	topic        string
+	topicPath    string // topicPath is where the topic is kept on disk, or empty if it is only kept in memory
+}
+
+const (
+	logBacklog  = 1024 // logBacklog is how many published messages can wait for the log writer of a room. After that, the broadcaster waits for it
+	roomBacklog = 256  // roomBacklog is how many events can wait for the broadcaster of a room. After that, listeners wait to hand theirs over, which slows down the clients that send them rather than dropping anything
+)
+
+// openRoom opens the room called name, loading its history and topic from the log if there is one, and starts its broadcaster
+func openRoom(name string) (*room, error) {
+	r := &room{
+		name:         name,
+		clients:      make(map[*Client]bool),
+		clientToID:   make(map[*Client]uint32),
+		eventChannel: make(chan Evt, roomBacklog),
+		joinChannel:  make(chan *Client),
+		settleChan:   make(chan *Client),
+		quit:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+		activeMsgs:   make(map[uint32]*activeMsg),
+	}
+	if dir := cfg().LogDir; dir != "" {
+		err := r.openLog(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		err = r.loadTopic(filepath.Join(dir, name, "topic"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	go r.broadcaster()
+	return r, nil
+}
+
+// validRoom returns true if name can be used as the name of a room, and so also as the name of its directory in the log.
+// Names are up to 32 lowercase letters, digits, dashes and underscores
+func validRoom(name string) bool {
+	if name == "" || len(name) > 32 {
+		return false
+	}
+	for _, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkJoin rejects a join to name from a client with caps
+func checkJoin(caps events.Caps, name string) *events.Error {
+	if !caps.Has(events.CapRooms) {
+		return reject(events.ErrorInvalid, "joining a room needs the rooms capability")
+	}
+	if !validRoom(name) {
+		return reject(events.ErrorInvalid, "%q is not a valid room name", name)
+	}
+	if !cfg().allows(name) {
+		return reject(events.ErrorInvalid, "there is no room called %q", name)
+	}
+	return nil
+}
+
+// moveTo moves client from the room it is in to to, which it has entered, where it is welcomed as if it had just connected.
+// It is only called by the client's listener, which is the only thing that changes which room a client is in
+func (h *hub) moveTo(client *Client, to *room) {
+	if client.room == to {
+		h.leave(to)
+		return
+	}
+	client.room.remove(client)
+	h.leave(client.room)
+	client.room = to
+	to.joinChannel <- client
+}
+
+// remove asks the broadcaster of r to forget client, and waits until it has
+func (r *room) remove(client *Client) {
+	done := make(chan struct{})
+	r.eventChannel <- Evt{client: client, done: done}
+	<-done
+}
+
+// leave forgets client, so that nothing more is sent to it from r, ends its active message, and tells everyone else that it left
+func (r *room) leave(client *Client) {
+	delete(r.clients, client)
+	r.finish(client)
+	delete(r.clientToID, client)
+	r.fanOut(nil, &events.UserLeave{}, client.userID)
+}
+
+// roster returns a user join for everyone in r, in the order that they connected, each followed by the key that they proved that they hold, if they did
+func (r *room) roster() []snapshotEvt {
+	present := make([]*Client, 0, len(r.clients))
+	for client := range r.clients {
+		present = append(present, client)
+	}
+	slices.SortFunc(present, func(a, b *Client) int { return cmp.Compare(a.userID, b.userID) })
+	evts := make([]snapshotEvt, 0, len(present))
+	for _, client := range present {
+		evts = append(evts, snapshotEvt{client.userID, &events.UserJoin{Color: client.color, Name: client.name}})
+		if client.key != nil {
+			evts = append(evts, snapshotEvt{client.userID, &events.Verified{Key: client.key}})
+		}
+	}
+	return evts
+}
+
+// broadcaster takes clients that join from the join channel and welcomes them, and takes events from the events channel and broadcasts them to all the connected clients individual event channels.
+// Since it handles both in order, a client that joins sees every event after it is caught up exactly once
+func (r *room) broadcaster() {
+	defer close(r.stopped)
+	for {
+		select {
+		case <-r.quit:
+			return
+		case client := <-r.joinChannel:
+			r.welcome(client)
+		case client := <-r.settleChan:
+			r.settle(client)
+		case evt := <-r.eventChannel:
+			if evt.evt == nil {
+				r.leave(evt.client)
+				close(evt.done)
+				continue
+			}
+			r.broadcast(evt)
+		}
+	}
+}
+
+// welcome registers client and sends it the welcome message, which is framed for each client since clients that move between rooms have already said hello. The client is then pending until it sends its hello, or its first other event, or until helloGrace passes,
+// so that what it missed can be sent in the version and caps that it speaks. A client that already said hello in another room is caught up straight away
+func (r *room) welcome(client *Client) {
+	r.fanOut(nil, &events.UserJoin{Color: client.color, Name: client.name}, client.userID)
+	if client.key != nil {
+		r.fanOut(nil, &events.Verified{Key: client.key}, client.userID)
+	}
+	r.clients[client] = true
+
+	client.pending = true
+	wm, err := events.MarshalServerEvent(client.version, &events.Ping{Welcome: cfg().welcomeFor(r.name)}, 0)
+	if err == nil {
+		client.send(wm)
+	}
+	if client.greeted {
+		r.settle(client)
+		return
+	}
+	time.AfterFunc(helloGrace, func() {
+		select {
+		case r.settleChan <- client:
+		case <-r.quit:
+		}
+	})
+}
+
+// close stops the broadcaster of r, which is only done once everyone has left a room with a log, and then waits for the log writer to write what is left and close the log,
+// so that the room can be opened again from the same directory
+func (r *room) close() {
+	close(r.quit)
+	<-r.stopped
+	if r.msgLog != nil {
+		close(r.logQueue)
+		<-r.logWritten
+	}
+}
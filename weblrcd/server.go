@@ -1,153 +1,544 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	events "weblrc"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// Client is a model for a client's connection, and their evtChannel, the queue of LRCEvents that have yet to be written to the connection
+// Client is a model for a client's connection, and their outbox, the queue of LRCEvents that have yet to be written to the connection.
+// userID identifies the client in presence events for as long as it is connected.
+// version and caps are what the client negotiated in its hello, greeted is set once it has said hello, pending is set until the client has been sent what it missed,
+// muted holds the authors whose events are not sent to the client, and color and name are from its last identify or init.
+// They are only touched by the broadcaster of the room the client is in. room is only touched by the client's listener.
+// identity is who the client was authenticated as, if anyone, and host is the -host that it signs its challenge for, which is empty if it isn't challenged. Neither ever changes.
+// nonce is the challenge that the client was sent and hasn't proved yet, and key is the key that it proved that it holds, if it did, which the broadcaster also owns
 type Client struct {
-	conn    *websocket.Conn
-	evtChan chan events.LRCEvent
+	conn     lrcConn
+	out      *outbox
+	userID   uint32
+	identity *Identity
+	host     string
+	nonce    []byte
+	key      ed25519.PublicKey
+	version events.Version
+	caps    events.Caps
+	greeted bool
+	pending bool
+	muted   map[*Client]bool
+	color   uint8
+	name    string
+	room    *room
 }
 
-// Evt is a model for an lrc event from a specific client
+// lrcConn is a connection to a client that carries one frame at a time, whether it is a websocket or a raw tcp stream
+type lrcConn interface {
+	// readEvent returns the data of the next frame from the client, which is framed in v.
+	// The data may only be valid until the next call
+	readEvent(v events.Version) (events.LRCTypedData, error)
+	// writeEvent writes an event that has already been framed for the client
+	writeEvent(q queued) error
+	// flush sends anything that writeEvent has buffered
+	flush() error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// wsConn is an lrcConn over a websocket, where every message is a single frame
+type wsConn struct {
+	*websocket.Conn
+}
+
+func (c wsConn) readEvent(v events.Version) (events.LRCTypedData, error) {
+	for {
+		_, frame, err := c.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		logDebug(fmt.Sprintf("read %x", frame))
+		td, err := events.Unframe(v, frame)
+		if err != nil {
+			logDebug(fmt.Sprintf("skipped %x: %s", frame, err))
+			continue
+		}
+		return td, nil
+	}
+}
+
+// writeEvent writes q as a single websocket message, reusing its prepared message if it has one, so that an event fanned out to many clients is framed once
+func (c wsConn) writeEvent(q queued) error {
+	if q.pm != nil {
+		return c.WritePreparedMessage(q.pm)
+	}
+	return c.WriteMessage(websocket.BinaryMessage, q.se)
+}
+
+func (c wsConn) flush() error {
+	return nil
+}
+
+// peer is what determines how an event is encoded for a client
+type peer struct {
+	version events.Version
+	caps    events.Caps
+}
+
+// Evt is a model for an lrc event from a specific client. An Evt without an event means that the client is leaving the room,
+// and done is closed once the room has forgotten it. Leaving goes through the same channel as events, so that the client's events before it are handled first
 type Evt struct {
 	client *Client
-	evt    events.LRCEvent
+	evt    events.Event
+	done   chan struct{}
 }
 
 var (
-	clients      = make(map[*Client]bool)
-	clientToID   = make(map[*Client]uint32)
-	lastID       = uint32(0)
-	eventChannel = make(chan Evt, 100)
-	clientsMu    sync.Mutex
-	prod         bool = false
-	wm = append([]byte{byte(events.EventPing)}, []byte("Welcome To The Beginning Of The Rest Of Your Life")...)
-
+	helloGrace = 500 * time.Millisecond // helloGrace is how long a client has to send its hello before it is caught up without one
+	serverCaps = events.CapMultiInsert | events.CapRangeEdit | events.CapErrors | events.CapHistory | events.CapRooms | events.CapTopic | events.CapThreads | events.CapPresence | events.CapIdentity | events.CapAbandon | events.CapSigned
 )
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	CheckOrigin: checkOrigin,
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
+
+// handler serves websocket clients on /ws, who are put in the default room, and on /ws/<room>, who are put in that room
+func (h *hub) handler(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/ws"), "/")
+	if name == "" {
+		name = cfg().DefaultRoom
+	}
+	if !cfg().allows(name) {
+		http.Error(w, fmt.Sprintf("there is no room called %q", name), http.StatusNotFound)
+		return
+	}
+	id, err := h.auth.Authenticate(r)
+	if err != nil {
+		logDebug(fmt.Sprintf("refused %s: %s", r.RemoteAddr, err))
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("Upgrade failed:", err)
 		return
 	}
-	defer conn.Close()
-	client := &Client{conn: conn, evtChan: make(chan events.LRCEvent)}
-	clientsMu.Lock()
-	clients[client] = true
-	clientsMu.Unlock()
+	h.serve(wsConn{conn}, name, id, cfg().Host)
+}
 
+// serve registers a client on conn with the broadcaster of the room called name, welcomes it, and relays its events until it disconnects.
+// The client is known as id, if it isn't nil, and signs its challenge for host, unless host is empty, in which case it isn't offered CapSigned.
+// Once it disconnects, it leaves the room it is in, and only then is its outbox closed, since nothing is queued for it after that
+func (h *hub) serve(conn lrcConn, name string, id *Identity, host string) {
+	defer conn.Close()
+	rm, err := h.enter(name)
+	if err != nil {
+		log.Println("failed to open room", name, err)
+		return
+	}
+	client := &Client{conn: conn, out: newOutbox(), userID: h.nextUserID(), identity: id, host: host, version: events.V1, room: rm}
+	if id != nil {
+		client.name = id.Name
+	}
 
 	var wg sync.WaitGroup
-	wg.Add(2)
+	wg.Add(1)
 	go func() { defer wg.Done(); clientWriter(client) }()
-	go func() { defer wg.Done(); listenToClient(client) }()
-	client.evtChan <- wm
-	wg.Wait()
+	rm.joinChannel <- client
+	h.listenToClient(client)
 
-	clientsMu.Lock()
-	delete(clients, client)
-	close(client.evtChan)
-	clientsMu.Unlock()
+	client.room.remove(client)
+	h.leave(client.room)
+	client.out.close()
 	conn.Close()
+	wg.Wait()
 	logDebug("Closed connection")
 }
 
 
 func main() {
-	go broadcaster()
-	wm, _ = events.GenServerEvent(wm, 0)
-	http.HandleFunc("/ws", handler)
-	log.Fatal(http.ListenAndServe(":927", nil))
+	flag.Parse()
+	c, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	current.Store(c)
+	go reloadOnHangup()
+	h := newHub(tokenAuth{})
+	// the server holds a place in the default room, so that it is never closed
+	_, err = h.enter(c.DefaultRoom)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var tlsConf *tls.Config
+	if c.TLSCert != "" {
+		certs, err := newCertReloader(c.TLSCert, c.TLSKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsConf = certs.tlsConfig()
+	}
+	if c.TCP != "" {
+		go func() { log.Fatal(h.listenTCP(c.TCP, tlsConf)) }()
+	}
+	http.HandleFunc("/ws", h.handler)
+	http.HandleFunc("/ws/", h.handler)
+	if tlsConf != nil {
+		srv := &http.Server{Addr: c.Listen, TLSConfig: tlsConf}
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(http.ListenAndServe(c.Listen, nil))
 }
 
-// listenToClient polls the clients connection and then sends any daya it recieves to the degunker.
-// If the connection closes, it closes readChan, which causes degunker to close quit
-func listenToClient(client *Client) {
+// listenToClient polls the clients connection, and then sends any events it recieves to the broadcaster of the room it is in.
+// A hello changes the version that the rest of the client's events are framed in, and a join moves it to another room
+func (h *hub) listenToClient(client *Client) {
+	v := events.V1
+	var caps events.Caps
 	for {
-		_, evt, err := client.conn.ReadMessage()
+		td, err := client.conn.readEvent(v)
 		if err != nil {
 			return
 		}
-		logDebug(fmt.Sprintf("read %x", evt))
-		eventChannel <- Evt{client, evt[1:]}
+		evt, err := events.Decode(td)
+		if err != nil {
+			logDebug(fmt.Sprintf("skipped %x: %s", td, err))
+			continue
+		}
+		if ping, ok := evt.(*events.Ping); ok && ping.Hello != nil {
+			v = events.Negotiate(ping.Hello.Version, events.MaxVersion)
+			caps = events.Shared(ping.Hello.Caps, serverCaps)
+		}
+		if join, ok := evt.(*events.Join); ok && checkJoin(caps, join.Room) == nil {
+			to, err := h.enter(join.Room)
+			if err == nil {
+				h.moveTo(client, to)
+				continue
+			}
+			log.Println("failed to open room", join.Room, err)
+		}
+		client.room.eventChannel <- Evt{client: client, evt: evt}
 	}
 }
 
-// clientWriter takes an event from the clients event channel, and writes it to the tcp connection.
-// If the degunker runs into an error, or if the client's eventChannel closes, then this returns
+// clientWriter takes everything waiting in the client's outbox, writes it to the connection, and flushes.
+// A client that takes longer than -grace to read a batch is disconnected, as is an evicted client once it has been told why.
+// Disconnecting closes the connection, so the client's listener stops, and the client leaves its room. If the outbox closes, then this returns
 func clientWriter(client *Client) {
+	var batch []queued
+	var evicted, ok bool
 	for {
-		evt, ok := <-client.evtChan
+		batch, evicted, ok = client.out.take(batch)
 		if !ok {
 			return
 		}
-		client.conn.WriteMessage(websocket.BinaryMessage, evt)
+		err := writeBatch(client.conn, batch)
+		if err != nil && client.out.evict(nil) {
+			log.Println("disconnecting client", client.userID, "since it couldn't be written to:", err)
+		}
+		if err != nil || evicted {
+			client.conn.Close()
+			return
+		}
 	}
 }
 
-// broadcaster takes an event from the events channel, and broadcasts it to all the connected clients individual event channels
-func broadcaster() {
-	for evt := range eventChannel {
-		logDebug(fmt.Sprintf("recieved %x from %x", evt.evt, evt.client))
-		id := clientToID[evt.client]
-		if id == 0 {
-			if !(events.IsInit(evt.evt) || events.IsPing(evt.evt)) {
-				logDebug(fmt.Sprintf("skipped %x", evt.evt))
+// writeBatch writes every event in batch to conn and flushes them, giving up once -grace passes
+func writeBatch(conn lrcConn, batch []queued) error {
+	conn.SetWriteDeadline(time.Now().Add(time.Duration(cfg().Grace)))
+	for _, q := range batch {
+		err := conn.writeEvent(q)
+		if err != nil {
+			return err
+		}
+	}
+	return conn.flush()
+}
+
+// send queues se for client. It is only used for events meant for that one client, which can't make it be evicted
+func (c *Client) send(se events.LRCServerEvent) {
+	c.out.push(queued{se: se}, cfg().Backlog)
+}
+
+// settle catches up a pending client on what it missed, which is who is in the room, the topic, the history if it has CapHistory, and then a snapshot of every active message
+func (r *room) settle(client *Client) {
+	// a client that isn't in r may belong to the broadcaster of another room by now, so it is checked before anything else about the client
+	_, connected := r.clients[client]
+	if !connected || !client.pending {
+		return
+	}
+	client.pending = false
+	missed := r.roster()
+	if r.topic != "" {
+		missed = append(missed, snapshotEvt{0, &events.SetTopic{Topic: r.topic}})
+	}
+	if client.caps.Has(events.CapHistory) {
+		missed = append(missed, r.replay()...)
+	}
+	missed = append(missed, r.snapshot()...)
+	p := peer{client.version, client.caps}
+	for _, evt := range missed {
+		for _, de := range p.downgrade(evt.evt) {
+			se, err := events.MarshalServerEvent(p.version, de, evt.id)
+			if err != nil {
+				logDebug(fmt.Sprintf("skipped catching up on %#v: %s", de, err))
 				continue
 			}
-			clientToID[evt.client] = lastID + 1
-			lastID += 1
-			id = lastID
+			client.send(se)
 		}
-		if events.IsPing(evt.evt) {
-			evt.client.evtChan <- events.ServerPong
-			continue
+	}
+}
+
+// broadcast validates an event from a client, and then sends it to every client in r
+func (r *room) broadcast(evt Evt) {
+	logDebug(fmt.Sprintf("recieved %#v from %p in %s", evt.evt, evt.client, r.name))
+	id := r.clientToID[evt.client]
+	switch e := evt.evt.(type) {
+	case *events.Ping:
+		if e.Hello != nil {
+			greet(evt.client, e.Hello)
+			r.settle(evt.client)
+			return
+		}
+		r.settle(evt.client)
+		pong, _ := events.MarshalServerEvent(evt.client.version, &events.Pong{}, 0)
+		evt.client.send(pong)
+		return
+	case *events.Init:
+		e.Echo, e.Replay = false, false
+		if e.Identified {
+			e.Identified = false
+			e.Color, e.Name = evt.client.color, evt.client.name
+		}
+		e.Name = evt.client.nick(e.Name)
+		e.Key = evt.client.key
+	case *events.Pub:
+		e.Time = time.Now()
+	case *events.Join:
+		// the listener moves clients that can join, so this join was refused
+		err := checkJoin(evt.client.caps, e.Room)
+		if err == nil {
+			err = reject(events.ErrorInvalid, "room %q could not be opened", e.Room)
 		}
-		if events.IsPub(evt.evt) {
-			clientToID[evt.client] = 0
+		sendError(evt.client, 0, err)
+		return
+	}
+	r.settle(evt.client)
+	switch e := evt.evt.(type) {
+	case *events.MuteUser:
+		r.mute(evt.client, e.ID, true)
+		return
+	case *events.UnmuteUser:
+		r.mute(evt.client, e.ID, false)
+		return
+	case *events.SetTopic:
+		r.setTopic(evt.client, e.Topic)
+		return
+	case *events.Identify:
+		r.identify(evt.client, e.Color, evt.client.nick(e.Name))
+		return
+	case *events.Prove:
+		r.prove(evt.client, e)
+		return
+	}
+	if init, ok := evt.evt.(*events.Init); ok && init.Parent != 0 && !r.exists(init.Parent) {
+		logDebug(fmt.Sprintf("rejected %#v: no parent", evt.evt))
+		sendError(evt.client, id, reject(events.ErrorNoMessage, "cannot reply to message %d, which doesn't exist", init.Parent))
+		return
+	}
+	if id == 0 {
+		if evt.evt.Type() != events.EventInit {
+			logDebug(fmt.Sprintf("skipped %#v", evt.evt))
+			sendError(evt.client, 0, reject(events.ErrorNoMessage, "%s without an active message, which may have already been published", evt.evt.Type()))
+			return
 		}
-		bevt, eevt := events.GenServerEvent(evt.evt, id)
-		logDebug("success")
+		r.clientToID[evt.client] = r.lastID + 1
+		r.lastID += 1
+		id = r.lastID
+		r.activeMsgs[id] = &activeMsg{id: id, author: evt.client}
+	} else if evt.evt.Type() == events.EventInit {
+		logDebug(fmt.Sprintf("rejected %#v: already active", evt.evt))
+		sendError(evt.client, id, reject(events.ErrorInvalid, "init while message %d is active, which has to be published first", id))
+		return
+	}
+	if err := r.activeMsgs[id].apply(evt.evt); err != nil {
+		logDebug(fmt.Sprintf("rejected %#v: %s", evt.evt, err))
+		sendError(evt.client, id, err)
+		return
+	}
+	if init, ok := evt.evt.(*events.Init); ok {
+		r.identify(evt.client, init.Color, init.Name)
+	}
+	if pub, ok := evt.evt.(*events.Pub); ok {
+		r.clientToID[evt.client] = 0
+		r.remember(r.activeMsgs[id], pub.Time)
+		delete(r.activeMsgs, id)
+	}
+	logDebug("success")
+	r.fanOut(evt.client, evt.evt, id)
+}
 
-		clientsMu.Lock()
-		for client := range clients {
-			evtToSend := bevt
-			if client == evt.client {
-				evtToSend = eevt
+// fanOut sends e from id to every client in r that is caught up and hasn't muted from, and echoes it back to from.
+// Events that don't come from a client, such as the topic, have a nil from
+func (r *room) fanOut(from *Client, e events.Event, id uint32) {
+	sevts := make(map[peer][2][]queued)
+	for client := range r.clients {
+		if client.pending || client.muted[from] {
+			continue
+		}
+		p := peer{client.version, client.caps}
+		se, ok := sevts[p]
+		if !ok {
+			bevts, eevts, err := genServerEvents(p, e, id)
+			if err != nil {
+				logDebug(fmt.Sprintf("skipped %#v for %+v: %s", e, p, err))
+				continue
 			}
-			select {
-			case client.evtChan <- evtToSend:
-				logDebug(fmt.Sprintf("b %x", bevt))
-			default:
-				logDebug("k")
-				err := client.conn.Close()
-				if err != nil {
-					delete(clients, client)
-				}
+			se = [2][]queued{bevts, eevts}
+			sevts[p] = se
+		}
+		evtsToSend := se[0]
+		if client == from {
+			evtsToSend = se[1]
+		}
+		for _, evtToSend := range evtsToSend {
+			if !r.trySend(client, evtToSend) {
+				break
 			}
 		}
-		clientsMu.Unlock()
 	}
 }
 
-// logDebug debugs unless in production
+// sendError tells client why its event for the message id was rejected, if it understands error events
+func sendError(client *Client, id uint32, e *events.Error) {
+	if !client.caps.Has(events.CapErrors) {
+		return
+	}
+	se, err := events.MarshalServerEvent(client.version, e, id)
+	if err != nil {
+		return
+	}
+	client.send(se)
+}
+
+// trySend queues q for client, unless it has fallen more than -maxbacklog events behind, or has been slow for longer than -grace, in which case it is evicted
+func (r *room) trySend(client *Client, q queued) bool {
+	c := cfg()
+	n, slowFor := client.out.push(q, c.Backlog)
+	switch {
+	case n > c.MaxBacklog:
+		evict(client, fmt.Sprintf("fell more than %d events behind", c.MaxBacklog))
+		return false
+	case slowFor > time.Duration(c.Grace):
+		evict(client, fmt.Sprintf("was more than %d events behind for longer than %s", c.Backlog, c.Grace.String()))
+		return false
+	}
+	return true
+}
+
+// evict drops everything waiting for client, and disconnects it once it is told why, if it understands error events.
+// It leaves its room the same way as any other client that disconnects
+func evict(client *Client, reason string) {
+	var last events.LRCServerEvent
+	if client.caps.Has(events.CapErrors) {
+		last, _ = events.MarshalServerEvent(client.version, reject(events.ErrorEvicted, "evicted, since this client %s", reason), 0)
+	}
+	if client.out.evict(last) {
+		log.Println("evicting client", client.userID, "since it", reason)
+	}
+}
+
+// greet answers a client's hello with the version and caps that both of them speak, and then uses them for the rest of the client's events
+func greet(client *Client, h *events.Hello) {
+	caps := serverCaps
+	if client.host == "" {
+		// without a host of our own for the client to check, a challenge could have been passed on from another server, so keys aren't proved at all
+		caps &^= events.CapSigned
+	}
+	agreed := &events.Hello{
+		Version: events.Negotiate(h.Version, events.MaxVersion),
+		Caps:    events.Shared(h.Caps, caps),
+	}
+	reply, _ := events.MarshalServerEvent(client.version, &events.Ping{Hello: agreed}, 0)
+	client.send(reply)
+	client.version = agreed.Version
+	client.caps = agreed.Caps
+	client.greeted = true
+	if client.caps.Has(events.CapSigned) {
+		challenge(client)
+	}
+}
+
+// challenge sends client a nonce to sign with its key, which binds the client to its key once it proves it
+func challenge(client *Client) {
+	client.nonce = make([]byte, events.NonceSize)
+	rand.Read(client.nonce)
+	se, err := events.MarshalServerEvent(client.version, &events.Challenge{Nonce: client.nonce, Host: client.host}, 0)
+	if err == nil {
+		client.send(se)
+	}
+}
+
+// downgrade returns the events that have the same effect as e for p, using only the caps that p has, and each fitting in a frame of the version that p speaks
+func (p peer) downgrade(e events.Event) []events.Event {
+	var evts []events.Event
+	for _, de := range events.Downgrade(e, p.caps) {
+		evts = append(evts, events.Fit(de, p.version)...)
+	}
+	return evts
+}
+
+// genServerEvents returns the server events that broadcast e from id to p, and the ones that echo it back to its sender, each prepared for websockets.
+// Inserts to peers with CapMultiInsert keep their insert, so that they can be merged while they wait
+func genServerEvents(p peer, e events.Event, id uint32) ([]queued, []queued, error) {
+	var bevts, eevts []queued
+	for _, de := range p.downgrade(e) {
+		se, err := events.MarshalServerEvent(p.version, de, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		pm, err := websocket.NewPreparedMessage(websocket.BinaryMessage, se)
+		if err != nil {
+			return nil, nil, err
+		}
+		bevt := queued{se: se, id: id, v: p.version, pm: pm}
+		if ins, ok := de.(*events.Insert); ok && p.caps.Has(events.CapMultiInsert) {
+			bevt.ins = ins
+		}
+		bevts = append(bevts, bevt)
+		init, ok := de.(*events.Init)
+		if !ok {
+			eevts = append(eevts, bevt)
+			continue
+		}
+		echo := *init
+		echo.Echo = true
+		eevt, err := events.MarshalServerEvent(p.version, &echo, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		epm, err := websocket.NewPreparedMessage(websocket.BinaryMessage, eevt)
+		if err != nil {
+			return nil, nil, err
+		}
+		eevts = append(eevts, queued{se: eevt, id: id, v: p.version, pm: epm})
+	}
+	return bevts, eevts, nil
+}
+
+// logDebug debugs if the log level is debug
 func logDebug(s string) {
-	if !prod {
+	if cfg().LogLevel == "debug" {
 		log.Println(s)
 	}
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	events "weblrc"
+)
+
+// tcpConn is an lrcConn over a raw tcp stream of frames, as spoken by native clients
+type tcpConn struct {
+	net.Conn
+	dec *events.Decoder
+	enc *events.Encoder
+}
+
+func newTCPConn(c net.Conn) *tcpConn {
+	return &tcpConn{Conn: c, dec: events.NewDecoder(c), enc: events.NewEncoder(c)}
+}
+
+func (c *tcpConn) readEvent(v events.Version) (events.LRCTypedData, error) {
+	c.dec.SetVersion(v)
+	td, err := c.dec.NextFrame()
+	if err != nil {
+		return nil, err
+	}
+	logDebug(fmt.Sprintf("read %x", td))
+	return td, nil
+}
+
+func (c *tcpConn) writeEvent(q queued) error {
+	return c.enc.WriteRaw(q.se)
+}
+
+func (c *tcpConn) flush() error {
+	return c.enc.Flush()
+}
+
+// listenTCP accepts raw tcp clients on addr, which start in the default room like websocket clients on /ws, and can join another room from there.
+// They aren't offered CapSigned, since -host is where websocket clients connect, so there is no host for them to sign their challenges for.
+// Clients connect over tls if there is a tlsConf
+func (h *hub) listenTCP(addr string, tlsConf *tls.Config) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	logDebug("listening for raw tcp on " + l.Addr().String())
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		deNagle(c)
+		if tlsConf != nil {
+			c = tls.Server(c, tlsConf)
+		}
+		go h.serve(newTCPConn(c), cfg().DefaultRoom, nil, "")
+	}
+}
+
+// deNagle disables Nagle's algorithm, so that keystrokes go out as soon as they are flushed instead of waiting to be pooled
+func deNagle(c net.Conn) {
+	if tcpConn, ok := c.(*net.TCPConn); ok {
+		tcpConn.SetNoDelay(true)
+	}
+}
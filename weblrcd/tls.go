@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloader serves the certificate in certPath and keyPath, loading it again whenever either file changes,
+// so that certificates can be rotated without a restart. A certificate that fails to load is logged, and the old one is kept
+type certReloader struct {
+	certPath string
+	keyPath  string
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time // modTimes is when the certificate and key had last changed when they were loaded
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	c := &certReloader{certPath: certPath, keyPath: keyPath}
+	err := c.load(c.stat())
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// stat returns when the certificate and key last changed, which are zero for files that can't be read
+func (c *certReloader) stat() [2]time.Time {
+	var mod [2]time.Time
+	for i, path := range []string{c.certPath, c.keyPath} {
+		if fi, err := os.Stat(path); err == nil {
+			mod[i] = fi.ModTime()
+		}
+	}
+	return mod
+}
+
+// load loads the certificate, remembering mod as when it last changed. It must be called with mu held, or before c is shared
+func (c *certReloader) load(mod [2]time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return err
+	}
+	c.cert, c.modTimes = &cert, mod
+	return nil
+}
+
+// getCertificate returns the certificate to serve, after loading it again if it has changed since it was last loaded
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if mod := c.stat(); mod != c.modTimes {
+		err := c.load(mod)
+		if err != nil {
+			log.Println("kept the old certificate, since the new one failed to load:", err)
+			c.modTimes = mod
+		} else {
+			log.Println("loaded the new certificate from", c.certPath)
+		}
+	}
+	return c.cert, nil
+}
+
+// tlsConfig returns the config to serve tls with, which picks up new certificates as they are rotated
+func (c *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{GetCertificate: c.getCertificate, MinVersion: tls.VersionTLS12}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"unicode/utf8"
+	events "weblrc"
+)
+
+// maxTopicLen is how many bytes a topic can be, which leaves room for it to fit in a V1 frame
+const maxTopicLen = 200
+
+// loadTopic restores the topic of r from path, and keeps the topic there from then on
+func (r *room) loadTopic(path string) error {
+	r.topicPath = path
+	topic, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	r.topic = string(topic)
+	return err
+}
+
+// saveTopic writes the topic of r to its path, through a temporary file so that a crash can't leave half of it
+func (r *room) saveTopic() error {
+	if r.topicPath == "" {
+		return nil
+	}
+	tmp := r.topicPath + ".tmp"
+	err := os.WriteFile(tmp, []byte(r.topic), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.topicPath)
+}
+
+// setTopic sets the topic of r to topic for client, and tells everyone in r about it
+func (r *room) setTopic(client *Client, topic string) {
+	if !utf8.ValidString(topic) {
+		sendError(client, 0, reject(events.ErrorInvalid, "topic is not valid utf-8"))
+		return
+	}
+	if len(topic) > maxTopicLen {
+		sendError(client, 0, reject(events.ErrorTooLong, "topic is %d bytes, longer than %d", len(topic), maxTopicLen))
+		return
+	}
+	r.topic = topic
+	err := r.saveTopic()
+	if err != nil {
+		log.Println("failed to save the topic of", r.name, err)
+	}
+	r.fanOut(nil, &events.SetTopic{Topic: topic}, 0)
+}